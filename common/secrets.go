@@ -0,0 +1,240 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// MasterKeyEnv is the environment variable the master keys can be passed in
+// instead of using a command line flag.
+const MasterKeyEnv = "GITHUB_BACKUP_MASTER_KEY"
+
+// secretHashes are the hashes (relative to the namespace) whose values are
+// sealed secrets. RotateSecrets re-wraps all of them.
+var secretHashes = []string{"tokens"}
+
+// sealedPrefix marks the envelope format.
+const sealedPrefix = "v1"
+
+// Sealer encrypts secrets before they are stored in Redis, so both the
+// frontend and the downloader can read them but Redis never sees them in
+// plain text.
+//
+// Secrets are envelope encrypted: every secret is encrypted with its own
+// random data key, which in turn is encrypted ("wrapped") with a master key.
+// A sealed secret has the form v1:<master key id>:<wrapped data key>:<data>.
+// Rotating the master key therefore only requires re-wrapping the data keys.
+// The data is bound to the place the secret is stored at (e.g. the hash
+// field), so a secret copied elsewhere does not open.
+type Sealer struct {
+	masters map[string]cipher.AEAD
+	// current is the id of the master key new secrets are sealed with.
+	current string
+}
+
+// NewSealer creates a Sealer from a comma separated list of base64 encoded
+// 256 bit master keys. The first key is used to seal, all of them can be
+// used to open secrets, which allows rotating keys. If s is empty, the keys
+// are read from the environment variable MasterKeyEnv. The variable is
+// removed from the environment either way, so child processes do not
+// inherit the keys.
+func NewSealer(s string) (*Sealer, error) {
+	env := os.Getenv(MasterKeyEnv)
+	os.Unsetenv(MasterKeyEnv)
+	if s == "" {
+		s = env
+	}
+	if s == "" {
+		return nil, fmt.Errorf("No master key given")
+	}
+	sealer := &Sealer{
+		masters: map[string]cipher.AEAD{},
+	}
+	for i, enc := range strings.Split(s, ",") {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode master key %d: %s", i+1, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Master key %d has to be 32 bytes long, got %d", i+1, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		sealer.masters[id] = aead
+		if i == 0 {
+			sealer.current = id
+		}
+	}
+	return sealer, nil
+}
+
+// GenerateMasterKey returns a new random base64 encoded master key.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// keyID identifies a master key without revealing it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt encrypts plaintext and authenticates it together with
+// additionalData with aead, prepending a random nonce.
+func encrypt(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// decrypt reverses encrypt.
+func decrypt(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid secret: too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt secret: %s", err)
+	}
+	return plaintext, nil
+}
+
+// Seal encrypts and authenticates plaintext with a new data key. The secret
+// can only be opened with the same context, which names where it is stored.
+func (s *Sealer) Seal(plaintext []byte, context string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	data, err := encrypt(aead, plaintext, []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return s.wrap(dataKey, data)
+}
+
+// wrap encrypts dataKey with the current master key and assembles the
+// sealed secret.
+func (s *Sealer) wrap(dataKey, data []byte) (string, error) {
+	wrapped, err := encrypt(s.masters[s.current], dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		sealedPrefix,
+		s.current,
+		base64.StdEncoding.EncodeToString(wrapped),
+		base64.StdEncoding.EncodeToString(data),
+	}, ":"), nil
+}
+
+// unwrap splits a sealed secret and decrypts its data key.
+func (s *Sealer) unwrap(sealed string) (id string, dataKey, data []byte, err error) {
+	parts := strings.Split(sealed, ":")
+	if len(parts) != 4 || parts[0] != sealedPrefix {
+		return "", nil, nil, fmt.Errorf("Invalid secret format")
+	}
+	master, ok := s.masters[parts[1]]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("Secret sealed with unknown master key %s", parts[1])
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("Invalid secret: %s", err)
+	}
+	if data, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+		return "", nil, nil, fmt.Errorf("Invalid secret: %s", err)
+	}
+	if dataKey, err = decrypt(master, wrapped, nil); err != nil {
+		return "", nil, nil, err
+	}
+	return parts[1], dataKey, data, nil
+}
+
+// Open decrypts a secret returned by Seal for the same context.
+func (s *Sealer) Open(sealed, context string) ([]byte, error) {
+	_, dataKey, data, err := s.unwrap(sealed)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(aead, data, []byte(context))
+}
+
+// Rewrap re-encrypts the data key of a sealed secret with the current
+// master key. The secret itself is not decrypted. changed is false if the
+// secret already used the current master key.
+func (s *Sealer) Rewrap(sealed string) (rewrapped string, changed bool, err error) {
+	id, dataKey, data, err := s.unwrap(sealed)
+	if err != nil {
+		return "", false, err
+	}
+	if id == s.current {
+		return sealed, false, nil
+	}
+	rewrapped, err = s.wrap(dataKey, data)
+	return rewrapped, err == nil, err
+}
+
+// RotateSecrets re-wraps all secrets stored in Redis with the current master
+// key and returns how many were changed. Afterwards, old master keys can be
+// dropped.
+func RotateSecrets(conn redis.Conn, sealer *Sealer, namespace string) (int, error) {
+	n := 0
+	for _, h := range secretHashes {
+		key := namespace + ":" + h
+		secrets, err := redis.StringMap(conn.Do("HGETALL", key))
+		if err != nil {
+			return n, err
+		}
+		for field, sealed := range secrets {
+			rewrapped, changed, err := sealer.Rewrap(sealed)
+			if err != nil {
+				return n, fmt.Errorf("Could not rewrap %s %s: %s", key, field, err)
+			}
+			if !changed {
+				continue
+			}
+			if _, err := conn.Do("HSET", key, field, rewrapped); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSealer(t *testing.T) {
+	oldKey, _ := GenerateMasterKey()
+	newKey, _ := GenerateMasterKey()
+	sealer, err := NewSealer(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealer.Seal([]byte("secret"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := sealer.Open(sealed, "alice"); err != nil || string(plain) != "secret" {
+		t.Errorf("Open returned %q, %v", plain, err)
+	}
+	if _, err := sealer.Open(sealed, "mallory"); err == nil {
+		t.Errorf("Secret opened in another context")
+	}
+
+	rotated, err := NewSealer(newKey + "," + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, changed, err := rotated.Rewrap(sealed)
+	if err != nil || !changed {
+		t.Fatalf("Rewrap returned %v, %v", changed, err)
+	}
+	if _, err := sealer.Open(rewrapped, "alice"); err == nil {
+		t.Errorf("Rewrapped secret opened with the old key")
+	}
+	if plain, err := rotated.Open(rewrapped, "alice"); err != nil || string(plain) != "secret" {
+		t.Errorf("Open after Rewrap returned %q, %v", plain, err)
+	}
+	if _, changed, _ := rotated.Rewrap(rewrapped); changed {
+		t.Errorf("Rewrap changed a secret sealed with the current key")
+	}
+}
+
+func TestSealerFromEnvironment(t *testing.T) {
+	key, _ := GenerateMasterKey()
+	os.Setenv(MasterKeyEnv, key)
+	if _, err := NewSealer(""); err != nil {
+		t.Fatal(err)
+	}
+	if v := os.Getenv(MasterKeyEnv); v != "" {
+		t.Errorf("%s is still set after reading it", MasterKeyEnv)
+	}
+}
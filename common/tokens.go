@@ -0,0 +1,45 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/oauth2"
+)
+
+// SaveToken stores the OAuth token of a GitHub user in the hash
+// <namespace>:tokens, encrypted with sealer and bound to login.
+func SaveToken(conn redis.Conn, sealer *Sealer, namespace, login string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealer.Seal(data, login)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", namespace+":tokens", login, sealed)
+	return err
+}
+
+// LoadToken retrieves the OAuth token of a GitHub user stored with
+// SaveToken.
+func LoadToken(conn redis.Conn, sealer *Sealer, namespace, login string) (*oauth2.Token, error) {
+	sealed, err := redis.String(conn.Do("HGET", namespace+":tokens", login))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("No token stored for %s", login)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := sealer.Open(sealed, login)
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("Invalid token for %s: %s", login, err)
+	}
+	return token, nil
+}
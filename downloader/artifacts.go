@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Besides the repository itself, its wiki and its releases can be backed up.
+//
+// With -wikis, the wiki is cloned next to the repository as <name>.wiki.git
+// and ends up in the same archive. Only repositories the frontend found to
+// have a wiki enabled are considered.
+//
+// With -releases, the release metadata is written to releases.jsonl in the
+// archive. As assets are large and do not change, they are not archived
+// every time but stored once per destination as
+// <archive dir>/releases/<tag>/<asset>. The assets stored on each
+// destination are kept in the hash <namespace>:assets:<destination>:<repo>,
+// mapping asset ids to their names.
+
+// hasWiki reports whether the metadata stored by the frontend says repo has
+// its wiki enabled.
+func hasWiki(conn redis.Conn, repo string) (bool, error) {
+	id, err := redis.String(conn.Do("HGET", *namespace+":repo_ids", repo))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	wiki, err := redis.Bool(conn.Do("HGET", *namespace+":repo:"+id, "has_wiki"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return wiki, err
+}
+
+// wikiURL returns the url of the wiki of the repository at cloneURL.
+func wikiURL(cloneURL string) string {
+	return strings.TrimSuffix(strings.TrimRight(cloneURL, "/"), ".git") + ".wiki.git"
+}
+
+// cloneWiki clones the wiki of repo into dir, if it has one. Wikis that are
+// enabled but were never written to do not exist and are skipped.
+func cloneWiki(conn redis.Conn, repo, cloneURL, dir string, cred *credential) error {
+	ok, err := hasWiki(conn, repo)
+	if err != nil || !ok {
+		return err
+	}
+	name := strings.TrimSuffix(bareName(repo), ".git") + ".wiki.git"
+	err = gitClone(dir, wikiURL(cloneURL), name, cred)
+	if ce, ok := err.(*cloneError); ok && ce.class == errClassNotFound {
+		os.RemoveAll(filepath.Join(dir, name))
+		return nil
+	}
+	return err
+}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	} `json:"assets"`
+}
+
+// backupReleases writes the releases of repo to releases.jsonl in dir and
+// stores assets not stored before on all dests.
+func backupReleases(conn redis.Conn, repo, dir string, cred *credential, dests []*destination) error {
+	owner, name, err := githubName(repo)
+	if err != nil {
+		return err
+	}
+	token := ""
+	if cred != nil {
+		token = cred.token
+	}
+	ghAPI, err := newGithubClient(token)
+	if err != nil {
+		return err
+	}
+	if err := exportList(ghAPI, "repos/"+owner+"/"+name+"/releases", url.Values{}, dir, "releases.jsonl", nil); err != nil {
+		return err
+	}
+	if len(dests) == 0 {
+		return nil
+	}
+
+	adir, err := archiveDir(repo)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(dir, "releases.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	client := githubHTTPClient(ghAPI.BaseURL.Host, token)
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		r := &githubRelease{}
+		if err := json.Unmarshal(line, r); err != nil {
+			return fmt.Errorf("Invalid release: %s", err)
+		}
+		for _, a := range r.Assets {
+			target := path.Join(adir, "releases", escapeSegment(r.TagName), escapeSegment(a.Name))
+			_, err := storeOnce(conn, "assets", repo, strconv.Itoa(a.ID), target, dests, func() (io.ReadCloser, error) {
+				return downloadAsset(client, a.URL, target)
+			})
+			if err != nil {
+				return fmt.Errorf("Could not store asset %s of %s: %s", a.Name, r.TagName, err)
+			}
+		}
+	}
+}
+
+// downloadAsset starts the download of the release asset at assetURL, which
+// is going to be stored as name.
+func downloadAsset(client *http.Client, assetURL, name string) (io.ReadCloser, error) {
+	log.Printf("Storing release asset %s...", name)
+	req, err := http.NewRequest("GET", assetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Download failed: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/surma-dump/github-backup/common"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// credential is the authentication used for repositories matching a
+// pattern. Patterns are of the form host[/owner[/repo]] and match all
+// repositories below them, e.g. "github.com/our-org". Either an SSH key or
+// an HTTPS token is used. Repositories authenticated with a token are cloned
+// over HTTPS, even if their url is an SSH one.
+type credential struct {
+	Match      string `json:"match"`
+	SSHKeyFile string `json:"ssh_key_file,omitempty"`
+	TokenFile  string `json:"token_file,omitempty"`
+	// Username sent along with the token. GitHub ignores it, other
+	// hosts (e.g. GitLab with "oauth2") may need a specific one.
+	Username string `json:"username,omitempty"`
+
+	token string
+}
+
+// credentialStore holds all configured credentials.
+type credentialStore []*credential
+
+// loadCredentials reads a JSON list of credentials from file.
+func loadCredentials(file string) (credentialStore, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cs := credentialStore{}
+	if err := json.Unmarshal(data, &cs); err != nil {
+		return nil, fmt.Errorf("Invalid credentials file: %s", err)
+	}
+	for _, c := range cs {
+		c.Match = strings.Trim(c.Match, "/")
+		if c.Match == "" {
+			return nil, fmt.Errorf("Credential without match pattern")
+		}
+		if (c.SSHKeyFile == "") == (c.TokenFile == "") {
+			return nil, fmt.Errorf("Credential for %s needs either ssh_key_file or token_file", c.Match)
+		}
+		if c.TokenFile != "" {
+			token, err := ioutil.ReadFile(c.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read token for %s: %s", c.Match, err)
+			}
+			c.token = strings.TrimSpace(string(token))
+		}
+	}
+	return cs, nil
+}
+
+// lookup returns the credential with the longest pattern matching repo, or
+// nil if there is none.
+func (cs credentialStore) lookup(repo string) *credential {
+	host, _, segments, err := splitRepoURL(repo)
+	if err != nil || host == localHost {
+		return nil
+	}
+	id := path.Join(append([]string{host}, segments...)...)
+	var best *credential
+	for _, c := range cs {
+		if id != c.Match && !strings.HasPrefix(id, c.Match+"/") {
+			continue
+		}
+		if best == nil || len(c.Match) > len(best.Match) {
+			best = c
+		}
+	}
+	return best
+}
+
+// httpsURL returns the HTTPS url of repo, converting SSH urls.
+func httpsURL(repo string) (string, error) {
+	if strings.HasPrefix(repo, "https://") || strings.HasPrefix(repo, "http://") {
+		return repo, nil
+	}
+	host, _, segments, err := splitRepoURL(repo)
+	if err != nil {
+		return "", err
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		// Drop the SSH port.
+		host = host[:i]
+	}
+	return "https://" + host + "/" + strings.Join(segments, "/"), nil
+}
+
+// credentialHelper answers git's credential requests from the environment,
+// so the token does not show up in the process list.
+const credentialHelper = `!f() { test "$1" = get && echo "username=$GITHUB_BACKUP_USERNAME" && echo "password=$GITHUB_BACKUP_TOKEN"; }; f`
+
+// gitEnv returns the url git has to use for repo and the additional
+// environment for git. A nil credential leaves both unchanged.
+func (c *credential) gitEnv(repo string) (string, []string, error) {
+	if c == nil {
+		return repo, nil, nil
+	}
+	if c.SSHKeyFile != "" {
+		return repo, []string{
+			"GIT_SSH_COMMAND=" + strings.Join(sshCommand(c.SSHKeyFile), " "),
+		}, nil
+	}
+
+	u, err := httpsURL(repo)
+	if err != nil {
+		return "", nil, err
+	}
+	user := c.Username
+	if user == "" {
+		user = "x-access-token"
+	}
+	return u, []string{
+		// Reset any configured helpers before adding ours.
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=credential.helper",
+		"GIT_CONFIG_VALUE_0=",
+		"GIT_CONFIG_KEY_1=credential.helper",
+		"GIT_CONFIG_VALUE_1=" + credentialHelper,
+		"GITHUB_BACKUP_USERNAME=" + user,
+		"GITHUB_BACKUP_TOKEN=" + c.token,
+		// Never fall back to prompting.
+		"GIT_TERMINAL_PROMPT=0",
+	}, nil
+}
+
+// gitEnviron returns the environment for git with env added.
+func gitEnviron(env []string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+// resolveCredential picks the credential to clone repo with and the url to
+// clone from. Entries of the credential store take precedence over the OAuth
+// token of the user who imported the repository. If neither exists, repo is
+// cloned with the default SSH key.
+func resolveCredential(conn redis.Conn, repo string) (*credential, string, error) {
+	if c := credentials.lookup(repo); c != nil {
+		return c, repo, nil
+	}
+	return tokenCredential(conn, repo)
+}
+
+// tokenCredential returns a credential using the OAuth token stored by the
+// frontend for repo, together with the repository's HTTPS clone url. Expired
+// tokens are refreshed and saved again.
+func tokenCredential(conn redis.Conn, repo string) (*credential, string, error) {
+	if sealer == nil {
+		return nil, repo, nil
+	}
+	login, err := redis.String(conn.Do("HGET", *namespace+":repo_tokens", repo))
+	if err == redis.ErrNil {
+		return nil, repo, nil
+	}
+	if err != nil {
+		return nil, repo, err
+	}
+	token, err := common.LoadToken(conn, sealer, *namespace, login)
+	if err != nil {
+		return nil, repo, err
+	}
+
+	config := &oauth2.Config{
+		ClientID:     *clientID,
+		ClientSecret: *clientSec,
+		Endpoint:     github.Endpoint,
+	}
+	fresh, err := config.TokenSource(oauth2.NoContext, token).Token()
+	if err != nil {
+		return nil, repo, fmt.Errorf("Could not refresh token of %s: %s", login, err)
+	}
+	if fresh.AccessToken != token.AccessToken {
+		if err := common.SaveToken(conn, sealer, *namespace, login, fresh); err != nil {
+			return nil, repo, err
+		}
+	}
+
+	cloneURL, err := redis.String(conn.Do("HGET", *namespace+":clone_urls", repo))
+	if err == redis.ErrNil {
+		cloneURL = repo
+	} else if err != nil {
+		return nil, repo, err
+	}
+	return &credential{Match: login, token: fresh.AccessToken}, cloneURL, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// destination is a storage together with a name that identifies it in logs
+// and statuses without revealing credentials.
+type destination struct {
+	name string
+	storage
+}
+
+func openDestination(s string) (*destination, error) {
+	st, err := openStorage(s)
+	if err != nil {
+		return nil, err
+	}
+	return &destination{
+		name:    redactURL(s),
+		storage: st,
+	}, nil
+}
+
+// redactURL strips passwords and query parameters, which may contain
+// credentials, from a destination url.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "<invalid url>"
+	}
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+// stringList is a flag that can be given multiple times.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return ""
+}
+
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
+
+// uploadAll archives dir once and streams the archive to all destinations
+// in parallel. Destinations that fail are retried on their own with a fresh
+// archive. The returned map holds the final error of every destination by
+// name.
+func uploadAll(dests []*destination, name, dir string) map[string]error {
+	errs := map[string]error{}
+	r, err := tarDir(dir)
+	if err != nil {
+		for _, d := range dests {
+			errs[d.name] = err
+		}
+		return errs
+	}
+	stores := make([]storage, len(dests))
+	for i, d := range dests {
+		stores[i] = d
+	}
+	for i, err := range tee(r, name, stores) {
+		errs[dests[i].name] = err
+	}
+	r.Close()
+
+	for _, d := range dests {
+		if errs[d.name] == nil || *retries < 2 {
+			continue
+		}
+		log.Printf("Upload to %s failed (%s), retrying...", d.name, errs[d.name])
+		errs[d.name] = upload(d, name, dir, *retries-1)
+	}
+	return errs
+}
+
+// tee copies r to all stores concurrently. A store that fails is dropped
+// from the copy without affecting the others.
+func tee(r io.Reader, name string, stores []storage) []error {
+	errs := make([]error, len(stores))
+	writers := make([]*io.PipeWriter, len(stores))
+	wg := &sync.WaitGroup{}
+	for i, st := range stores {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, st storage) {
+			defer wg.Done()
+			errs[i] = st.Store(name, pr)
+			if errs[i] != nil {
+				pr.CloseWithError(errs[i])
+			} else {
+				pr.Close()
+			}
+		}(i, st)
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, w := range writers {
+				if w == nil {
+					continue
+				}
+				if _, err := w.Write(buf[:n]); err != nil {
+					writers[i] = nil
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			for _, w := range writers {
+				if w != nil {
+					w.CloseWithError(err)
+				}
+			}
+			writers = nil
+			break
+		}
+	}
+	for _, w := range writers {
+		if w != nil {
+			w.Close()
+		}
+	}
+	wg.Wait()
+	return errs
+}
+
+// registerDestinations adds the names of dests to the set
+// <namespace>:destinations and closes conn.
+func registerDestinations(conn redis.Conn, dests []*destination) error {
+	defer conn.Close()
+	for _, d := range dests {
+		if _, err := conn.Do("SADD", *namespace+":destinations", d.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedKey returns the hash recording, by id, which files of the given
+// kind of repo are stored on dest, and under which name.
+func storedKey(kind string, dest *destination, repo string) string {
+	return *namespace + ":" + kind + ":" + dest.name + ":" + repo
+}
+
+// storeOnce stores the file with the given id as name on each of dests that
+// does not have it yet, and reports whether any needed it. open is only
+// called if one does. Stores are recorded per destination, so a failed one
+// is retried on its own and destinations added later catch up.
+func storeOnce(conn redis.Conn, kind, repo, id, name string, dests []*destination, open func() (io.ReadCloser, error)) (bool, error) {
+	missing := []*destination{}
+	for _, d := range dests {
+		stored, err := redis.Bool(conn.Do("HEXISTS", storedKey(kind, d, repo), id))
+		if err != nil {
+			return false, err
+		}
+		if !stored {
+			missing = append(missing, d)
+		}
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+	r, err := open()
+	if err != nil {
+		return true, err
+	}
+	defer r.Close()
+	stores := make([]storage, len(missing))
+	for i, d := range missing {
+		stores[i] = d
+	}
+	failed := []string{}
+	for i, err := range tee(r, name, stores) {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", missing[i].name, err))
+			continue
+		}
+		if _, err := conn.Do("HSET", storedKey(kind, missing[i], repo), id, name); err != nil {
+			return true, err
+		}
+	}
+	if len(failed) > 0 {
+		return true, fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return true, nil
+}
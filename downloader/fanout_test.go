@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// memStorage keeps stored files in memory and can be made to fail.
+type memStorage struct {
+	files map[string]string
+	fail  bool
+}
+
+func (ms *memStorage) Store(name string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if ms.fail {
+		return fmt.Errorf("Disk full")
+	}
+	ms.files[name] = string(b)
+	return nil
+}
+
+func (ms *memStorage) Close() error {
+	return nil
+}
+
+func TestStoreOncePerDestination(t *testing.T) {
+	conn := newFakeConn()
+	a := &destination{name: "a", storage: &memStorage{files: map[string]string{}}}
+	b := &destination{name: "b", storage: &memStorage{files: map[string]string{}, fail: true}}
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewBufferString("content")), nil
+	}
+	store := func(dests ...*destination) error {
+		_, err := storeOnce(conn, "lfs", "repo", "oid", "dir/oid", dests, open)
+		return err
+	}
+
+	if err := store(a, b); err == nil {
+		t.Fatalf("Failure on b was not reported")
+	}
+	b.storage.(*memStorage).fail = false
+	a.storage.(*memStorage).files = map[string]string{}
+	if err := store(a, b); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := a.storage.(*memStorage).files["dir/oid"]; ok {
+		t.Errorf("File was stored on a again")
+	}
+	if got := b.storage.(*memStorage).files["dir/oid"]; got != "content" {
+		t.Errorf("b has %q, expected the file", got)
+	}
+
+	c := &destination{name: "c", storage: &memStorage{files: map[string]string{}}}
+	if err := store(a, b, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := c.storage.(*memStorage).files["dir/oid"]; got != "content" {
+		t.Errorf("New destination c has %q, expected the file", got)
+	}
+	if err := store(a, b, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if opened != 3 {
+		t.Errorf("File was opened %d times, expected 3", opened)
+	}
+	if got := conn.hashes[storedKey("lfs", c, "repo")]["oid"]; got != "dir/oid" {
+		t.Errorf("Record on c is %q, expected dir/oid", got)
+	}
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ftpOptions configures how an ftpConn talks to the server.
+type ftpOptions struct {
+	// implicitTLS wraps the control connection in TLS right away (ftps://),
+	// explicitTLS upgrades it with AUTH TLS.
+	implicitTLS bool
+	explicitTLS bool
+	tlsConfig   *tls.Config
+	// active makes the server connect back to us for data transfers
+	// instead of using passive mode.
+	active bool
+	// timeout limits how long connecting, each command and its response
+	// and every read or write on a data connection may take, so a broken
+	// connection is noticed instead of blocking forever.
+	timeout time.Duration
+}
+
+// defaultFtpTimeout is the timeout used unless the url sets one.
+const defaultFtpTimeout = time.Minute
+
+// parseFtpOptions reads the connection options from the scheme and query
+// of an FTP destination url:
+//
+//	ftps://host/path              implicit TLS
+//	ftp://host/path?tls=explicit  explicit TLS (AUTH TLS)
+//	ca=<file>                     CA bundle to verify the server with
+//	cert=<file>&key=<file>        client certificate
+//	mode=passive|active           data connection mode, default passive
+//	timeout=<duration>            network timeout, default 1m
+func parseFtpOptions(u *url.URL) (*ftpOptions, error) {
+	q := u.Query()
+	opts := &ftpOptions{
+		implicitTLS: u.Scheme == "ftps",
+		timeout:     defaultFtpTimeout,
+	}
+	switch q.Get("tls") {
+	case "":
+	case "explicit":
+		opts.explicitTLS = !opts.implicitTLS
+	case "implicit":
+		opts.implicitTLS = true
+	default:
+		return nil, fmt.Errorf("Unsupported tls mode %s", q.Get("tls"))
+	}
+	switch q.Get("mode") {
+	case "", "passive":
+	case "active":
+		opts.active = true
+	default:
+		return nil, fmt.Errorf("Unsupported transfer mode %s", q.Get("mode"))
+	}
+	if t := q.Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %s", t)
+		}
+		opts.timeout = d
+	}
+
+	if !opts.implicitTLS && !opts.explicitTLS {
+		return opts, nil
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+	opts.tlsConfig = &tls.Config{
+		ServerName: host,
+		// Hardened servers require data connections to resume the TLS
+		// session of the control connection.
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if ca := q.Get("ca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA bundle: %s", err)
+		}
+		opts.tlsConfig.RootCAs = x509.NewCertPool()
+		if !opts.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", ca)
+		}
+	}
+	if cert := q.Get("cert"); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, q.Get("key"))
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %s", err)
+		}
+		opts.tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return opts, nil
+}
+
+// ftpConn is a minimal FTP client covering what is needed to upload
+// archives. Responses are read with net/textproto, so multi-line replies
+// are handled correctly.
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+	opts *ftpOptions
+	// dataTLS is set once data connections are protected (PROT P).
+	dataTLS *tls.Config
+	// noEPSV is set once the server rejected EPSV.
+	noEPSV bool
+}
+
+func dialFtp(addr string, opts *ftpOptions) (*ftpConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: opts.timeout}
+	if opts.implicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, opts.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{
+		conn: conn,
+		text: textproto.NewConn(conn),
+		opts: opts,
+	}
+	c.deadline()
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if opts.explicitTLS {
+		if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Server refused AUTH TLS: %s", err)
+		}
+		tlsConn := tls.Client(conn, opts.tlsConfig)
+		c.deadline()
+		if err := tlsConn.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+	}
+	return c, nil
+}
+
+// deadline gives the next exchange on the control connection the configured
+// timeout to complete.
+func (c *ftpConn) deadline() {
+	c.conn.SetDeadline(time.Now().Add(c.opts.timeout))
+}
+
+// cmd sends a command and reads the response, which is expected to match
+// the given code prefix (see textproto.Reader.ReadResponse).
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	c.deadline()
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+// Login authenticates with the server. On TLS connections, data connections
+// are protected as well afterwards.
+func (c *ftpConn) Login(user, pass string) error {
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+	case 331:
+		if _, _, err := c.cmd(2, "PASS %s", pass); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unexpected response to USER: %d", code)
+	}
+	return c.protect()
+}
+
+func (c *ftpConn) protect() error {
+	if c.opts.tlsConfig == nil {
+		return nil
+	}
+	if _, _, err := c.cmd(2, "PBSZ 0"); err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(2, "PROT P"); err != nil {
+		return err
+	}
+	c.dataTLS = c.opts.tlsConfig
+	return nil
+}
+
+func (c *ftpConn) Cwd(dir string) error {
+	_, _, err := c.cmd(2, "CWD %s", dir)
+	return err
+}
+
+func (c *ftpConn) Mkd(dir string) error {
+	_, _, err := c.cmd(2, "MKD %s", dir)
+	return err
+}
+
+func (c *ftpConn) Dele(name string) error {
+	_, _, err := c.cmd(2, "DELE %s", name)
+	return err
+}
+
+func (c *ftpConn) Noop() error {
+	_, _, err := c.cmd(2, "NOOP")
+	return err
+}
+
+func (c *ftpConn) Rename(from, to string) error {
+	if _, _, err := c.cmd(3, "RNFR %s", from); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(2, "RNTO %s", to)
+	return err
+}
+
+// Size returns the size of a remote file as reported by SIZE (RFC 3659).
+func (c *ftpConn) Size(name string) (int64, error) {
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return 0, err
+	}
+	_, msg, err := c.cmd(213, "SIZE %s", name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+// pasv enters passive mode and returns the address of the data connection.
+// EPSV (RFC 2428) is tried first, PASV is used if the server does not
+// support it. The host part announced by PASV is ignored in favour of the
+// host of the control connection, as servers behind NAT often announce
+// internal addresses.
+func (c *ftpConn) pasv() (string, error) {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+	var port int
+	if !c.noEPSV {
+		port, err = c.epsvPort()
+		if terr, ok := err.(*textproto.Error); ok && terr.Code/100 == 5 {
+			c.noEPSV = true
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if c.noEPSV {
+		if port, err = c.pasvPort(); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// epsvPort returns the port announced in response to EPSV, such as
+// "229 Entering Extended Passive Mode (|||6446|)".
+func (c *ftpConn) epsvPort() (int, error) {
+	_, msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return 0, err
+	}
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start+2 {
+		return 0, fmt.Errorf("Invalid EPSV response: %s", msg)
+	}
+	inner := msg[start+1 : end]
+	fields := strings.Split(inner, inner[:1])
+	if len(fields) != 5 {
+		return 0, fmt.Errorf("Invalid EPSV response: %s", msg)
+	}
+	port, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return 0, fmt.Errorf("Invalid EPSV response: %s", msg)
+	}
+	return port, nil
+}
+
+// pasvPort returns the port announced in response to PASV, such as
+// "227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+func (c *ftpConn) pasvPort() (int, error) {
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	start, end := strings.Index(msg, "("), strings.Index(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("Invalid PASV response: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("Invalid PASV response: %s", msg)
+	}
+	p1, err1 := strconv.Atoi(fields[4])
+	p2, err2 := strconv.Atoi(fields[5])
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("Invalid PASV response: %s", msg)
+	}
+	return p1<<8 + p2, nil
+}
+
+// port opens a listener for an active mode data connection and announces
+// it to the server with PORT (or EPRT for IPv6).
+func (c *ftpConn) port() (net.Listener, error) {
+	host, _, err := net.SplitHostPort(c.conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		_, _, err = c.cmd(2, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, _, err = c.cmd(2, "EPRT |2|%s|%d|", host, port)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// transfer runs a command that uses a data connection and hands the data
+// connection to fn. The final transfer response is always consumed, even if
+// fn fails, so it is not mistaken for the response of the next command.
+func (c *ftpConn) transfer(fn func(data net.Conn) error, format string, args ...interface{}) error {
+	var l net.Listener
+	var addr string
+	var err error
+	if c.opts.active {
+		if l, err = c.port(); err != nil {
+			return err
+		}
+		defer l.Close()
+	} else if addr, err = c.pasv(); err != nil {
+		return err
+	}
+
+	var data net.Conn
+	if !c.opts.active {
+		if data, err = net.DialTimeout("tcp", addr, c.opts.timeout); err != nil {
+			return err
+		}
+		defer data.Close()
+	}
+
+	c.deadline()
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	if _, _, err := c.text.ReadResponse(1); err != nil {
+		return err
+	}
+
+	if c.opts.active {
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(c.opts.timeout))
+		if data, err = l.Accept(); err != nil {
+			return err
+		}
+		defer data.Close()
+	}
+	// Transfers may take long, but must not stall.
+	data = &idleConn{Conn: data, timeout: c.opts.timeout}
+	if c.dataTLS != nil {
+		data = tls.Client(data, c.dataTLS)
+	}
+
+	fnErr := fn(data)
+	closeErr := data.Close()
+	c.deadline()
+	_, _, err = c.text.ReadResponse(2)
+	if fnErr != nil {
+		return fnErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// idleConn fails reads and writes that make no progress within timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (ic *idleConn) Read(p []byte) (int, error) {
+	ic.Conn.SetDeadline(time.Now().Add(ic.timeout))
+	return ic.Conn.Read(p)
+}
+
+func (ic *idleConn) Write(p []byte) (int, error) {
+	ic.Conn.SetDeadline(time.Now().Add(ic.timeout))
+	return ic.Conn.Write(p)
+}
+
+// Stor uploads r to name and returns the number of bytes sent.
+func (c *ftpConn) Stor(name string, r io.Reader) (int64, error) {
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := c.transfer(func(data net.Conn) error {
+		var err error
+		n, err = io.Copy(data, r)
+		return err
+	}, "STOR %s", name)
+	return n, err
+}
+
+// Retr downloads name to w.
+func (c *ftpConn) Retr(name string, w io.Writer) error {
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return err
+	}
+	return c.transfer(func(data net.Conn) error {
+		_, err := io.Copy(w, data)
+		return err
+	}, "RETR %s", name)
+}
+
+// Nlst returns the names of the files in dir.
+func (c *ftpConn) Nlst(dir string) ([]string, error) {
+	if _, _, err := c.cmd(2, "TYPE A"); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	err := c.transfer(func(data net.Conn) error {
+		r := textproto.NewReader(bufio.NewReader(data))
+		for {
+			line, err := r.ReadLine()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			names = append(names, line)
+		}
+	}, "NLST %s", dir)
+	return names, err
+}
+
+func (c *ftpConn) Close() error {
+	return c.text.Close()
+}
+
+// ftpStorage stores archives on an FTP server. Uploads are written to a
+// temporary name, verified with SIZE and renamed into place afterwards.
+//
+// The control connection is checked before every upload and transparently
+// re-established if the server dropped it.
+type ftpStorage struct {
+	sync.Mutex
+	url  *url.URL
+	opts *ftpOptions
+	conn *ftpConn
+}
+
+func newFtpStorage(u *url.URL) (*ftpStorage, error) {
+	opts, err := parseFtpOptions(u)
+	if err != nil {
+		return nil, err
+	}
+	fs := &ftpStorage{url: u, opts: opts}
+	if err := fs.connect(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// connect establishes the control connection, logs in and changes to the
+// target directory.
+func (fs *ftpStorage) connect() error {
+	addr := fs.url.Host
+	if !strings.Contains(addr, ":") {
+		if fs.opts.implicitTLS {
+			addr += ":990"
+		} else {
+			addr += ":21"
+		}
+	}
+	conn, err := dialFtp(addr, fs.opts)
+	if err != nil {
+		return err
+	}
+	if fs.url.User != nil {
+		pass, _ := fs.url.User.Password()
+		err = conn.Login(fs.url.User.Username(), pass)
+	} else {
+		err = conn.protect()
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Could not log in: %s", err)
+	}
+	if fs.url.Path != "" {
+		if err := conn.Cwd(fs.url.Path); err != nil {
+			conn.Close()
+			return fmt.Errorf("Could not cd to target directory: %s", err)
+		}
+	}
+	fs.conn = conn
+	return nil
+}
+
+// ensureConn makes sure there is a working control connection, reconnecting
+// if necessary.
+func (fs *ftpStorage) ensureConn() error {
+	if fs.conn != nil {
+		if err := fs.conn.Noop(); err == nil {
+			return nil
+		}
+		log.Printf("FTP connection to %s lost, reconnecting...", fs.url.Host)
+		fs.drop()
+	}
+	return fs.connect()
+}
+
+// drop closes a control connection that is considered broken.
+func (fs *ftpStorage) drop() {
+	fs.conn.Close()
+	fs.conn = nil
+}
+
+// isConnError reports whether err means the control connection can no
+// longer be used. Regular error replies leave the connection intact, except
+// for 421, with which the server announces it is closing the connection.
+func isConnError(err error) bool {
+	if terr, ok := err.(*textproto.Error); ok {
+		return terr.Code == 421
+	}
+	return true
+}
+
+// mkdirAll creates dir and all its parents relative to the current working
+// directory. Errors for directories that already exist are ignored, as FTP
+// offers no portable way to tell them apart from other failures.
+func (fs *ftpStorage) mkdirAll(dir string) {
+	cur := ""
+	for _, s := range strings.Split(dir, "/") {
+		cur = path.Join(cur, s)
+		fs.conn.Mkd(cur)
+	}
+}
+
+func (fs *ftpStorage) Store(name string, r io.Reader) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if err := fs.ensureConn(); err != nil {
+		return err
+	}
+	err := fs.store(name, r)
+	if err != nil && isConnError(err) {
+		fs.drop()
+	}
+	return err
+}
+
+func (fs *ftpStorage) store(name string, r io.Reader) error {
+	tmp := tempName(name)
+	fs.mkdirAll(path.Dir(name))
+	n, err := fs.conn.Stor(tmp, r)
+	if err != nil {
+		fs.conn.Dele(tmp)
+		return err
+	}
+	size, err := fs.conn.Size(tmp)
+	if err != nil {
+		fs.conn.Dele(tmp)
+		return fmt.Errorf("Could not verify upload: %s", err)
+	}
+	if size != n {
+		fs.conn.Dele(tmp)
+		return fmt.Errorf("Upload incomplete: sent %d bytes, server has %d", n, size)
+	}
+	if err := fs.conn.Rename(tmp, name); err != nil {
+		fs.conn.Dele(tmp)
+		return err
+	}
+	return nil
+}
+
+func (fs *ftpStorage) List(dir string) ([]string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if err := fs.ensureConn(); err != nil {
+		return nil, err
+	}
+	entries, err := fs.conn.Nlst(dir)
+	if err != nil {
+		if isConnError(err) {
+			fs.drop()
+		}
+		return nil, err
+	}
+	// Depending on the server, NLST returns bare names or full paths.
+	names := []string{}
+	for _, e := range entries {
+		if name := path.Base(e); isArchive(name) {
+			names = append(names, path.Join(dir, name))
+		}
+	}
+	return names, nil
+}
+
+func (fs *ftpStorage) Fetch(name string, w io.Writer) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if err := fs.ensureConn(); err != nil {
+		return err
+	}
+	err := fs.conn.Retr(name, w)
+	if err != nil && isConnError(err) {
+		fs.drop()
+	}
+	return err
+}
+
+func (fs *ftpStorage) Remove(name string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if err := fs.ensureConn(); err != nil {
+		return err
+	}
+	err := fs.conn.Dele(name)
+	if err != nil && isConnError(err) {
+		fs.drop()
+	}
+	return err
+}
+
+func (fs *ftpStorage) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.conn == nil {
+		return nil
+	}
+	fs.conn.cmd(2, "QUIT")
+	err := fs.conn.Close()
+	fs.conn = nil
+	return err
+}
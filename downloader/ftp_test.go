@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFtpTimeout checks that a server that stops answering is given up on
+// after the timeout instead of blocking uploads.
+func TestFtpTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("220 Ready\r\n"))
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					// Log in, then hang.
+					if strings.HasPrefix(line, "USER") {
+						conn.Write([]byte("230 Logged in\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	u, _ := url.Parse("ftp://user@" + l.Addr().String() + "?timeout=100ms")
+	fs, err := newFtpStorage(u)
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.Store("a/b"+archiveExt, bytes.NewBufferString("archive"))
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Store succeeded on an unresponsive server")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Store is still blocked")
+	}
+}
+
+// fakeFtpServer is an FTP server keeping files in memory. It answers with
+// multi-line replies where servers commonly do and records all commands.
+type fakeFtpServer struct {
+	l net.Listener
+	// epsv makes the server support EPSV, otherwise only PASV works.
+	epsv bool
+	// sizeDelta is added to the sizes SIZE reports.
+	sizeDelta int
+
+	mu       sync.Mutex
+	files    map[string]string
+	commands []string
+}
+
+func newFakeFtpServer(t *testing.T, epsv bool) *fakeFtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeFtpServer{l: l, epsv: epsv, files: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeFtpServer) url() *url.URL {
+	u, _ := url.Parse("ftp://user:pass@" + s.l.Addr().String())
+	return u
+}
+
+func (s *fakeFtpServer) Close() {
+	s.l.Close()
+}
+
+// sent returns the names of the commands received so far.
+func (s *fakeFtpServer) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *fakeFtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reply := func(lines ...string) {
+		conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+	reply("220-Welcome", "220-to the fake server", "220 Ready")
+
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	// accept waits for the data connection announced before.
+	accept := func() net.Conn {
+		if data == nil {
+			return nil
+		}
+		defer func() { data = nil }()
+		defer data.Close()
+		c, err := data.Accept()
+		if err != nil {
+			return nil
+		}
+		return c
+	}
+	listen := func() int {
+		if data != nil {
+			data.Close()
+		}
+		data, _ = net.Listen("tcp", "127.0.0.1:0")
+		return data.Addr().(*net.TCPAddr).Port
+	}
+
+	renameFrom := ""
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+		cmd, arg := fields[0], ""
+		if len(fields) == 2 {
+			arg = fields[1]
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		switch cmd {
+		case "USER":
+			reply("331 Password required")
+		case "PASS":
+			reply("230-Welcome back", " Lines without a code belong to the reply, too.", "230 Logged in")
+		case "TYPE", "NOOP":
+			reply("200 OK")
+		case "MKD":
+			reply("257 Created")
+		case "EPSV":
+			if !s.epsv {
+				reply("500 Unknown command")
+				continue
+			}
+			reply(fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", listen()))
+		case "PASV":
+			port := listen()
+			// The announced host is not reachable and has to be ignored.
+			reply(fmt.Sprintf("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff))
+		case "STOR":
+			reply("150 Opening data connection")
+			c := accept()
+			if c == nil {
+				reply("425 No data connection")
+				continue
+			}
+			content, _ := ioutil.ReadAll(c)
+			c.Close()
+			s.mu.Lock()
+			s.files[arg] = string(content)
+			s.mu.Unlock()
+			reply("226-Transfer complete", "226 Bye")
+		case "RETR", "NLST":
+			s.mu.Lock()
+			content, ok := s.files[arg]
+			if cmd == "NLST" {
+				names := []string{}
+				for name := range s.files {
+					if path.Dir(name) == arg {
+						names = append(names, name+"\r\n")
+					}
+				}
+				sort.Strings(names)
+				content, ok = strings.Join(names, ""), true
+			}
+			s.mu.Unlock()
+			if !ok {
+				reply("550 Not found")
+				continue
+			}
+			reply("150 Opening data connection")
+			c := accept()
+			if c == nil {
+				reply("425 No data connection")
+				continue
+			}
+			c.Write([]byte(content))
+			c.Close()
+			reply("226 Transfer complete")
+		case "SIZE":
+			s.mu.Lock()
+			content, ok := s.files[arg]
+			s.mu.Unlock()
+			if !ok {
+				reply("550 Not found")
+				continue
+			}
+			reply(fmt.Sprintf("213 %d", len(content)+s.sizeDelta))
+		case "RNFR":
+			renameFrom = arg
+			reply("350 Ready for RNTO")
+		case "RNTO":
+			s.mu.Lock()
+			content, ok := s.files[renameFrom]
+			if ok {
+				delete(s.files, renameFrom)
+				s.files[arg] = content
+			}
+			s.mu.Unlock()
+			if !ok {
+				reply("550 Not found")
+				continue
+			}
+			reply("250 Renamed")
+		case "DELE":
+			s.mu.Lock()
+			delete(s.files, arg)
+			s.mu.Unlock()
+			reply("250 Deleted")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func count(commands []string, cmd string) int {
+	n := 0
+	for _, c := range commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFtpStorage(t *testing.T) {
+	for _, epsv := range []bool{true, false} {
+		server := newFakeFtpServer(t, epsv)
+		defer server.Close()
+		fs, err := newFtpStorage(server.url())
+		if err != nil {
+			t.Fatalf("Could not connect: %s", err)
+		}
+		names := []string{"a/1" + archiveExt, "a/2" + archiveExt}
+		for _, name := range names {
+			if err := fs.Store(name, bytes.NewBufferString("archive "+name)); err != nil {
+				t.Fatalf("Store with EPSV %v failed: %s", epsv, err)
+			}
+		}
+		server.mu.Lock()
+		if len(server.files) != 2 || server.files[names[0]] != "archive "+names[0] {
+			t.Errorf("Files on the server with EPSV %v: %v", epsv, server.files)
+		}
+		server.mu.Unlock()
+
+		listed, err := fs.List("a")
+		if err != nil || !reflect.DeepEqual(listed, names) {
+			t.Errorf("List = %v, %v, expected %v", listed, err, names)
+		}
+		buf := &bytes.Buffer{}
+		if err := fs.Fetch(names[1], buf); err != nil || buf.String() != "archive "+names[1] {
+			t.Errorf("Fetch = %q, %v", buf.String(), err)
+		}
+		fs.Close()
+
+		sent := server.sent()
+		for _, cmd := range []string{"STOR", "SIZE", "RNFR", "RNTO"} {
+			if n := count(sent, cmd); n != 2 {
+				t.Errorf("%s sent %d times with EPSV %v, expected 2", cmd, n, epsv)
+			}
+		}
+		// A server without EPSV is only asked once.
+		if epsv && count(sent, "PASV") != 0 || !epsv && count(sent, "EPSV") != 1 {
+			t.Errorf("Passive mode commands with EPSV %v: %v", epsv, sent)
+		}
+	}
+}
+
+func TestFtpSizeMismatch(t *testing.T) {
+	server := newFakeFtpServer(t, true)
+	defer server.Close()
+	server.sizeDelta = -1
+	fs, err := newFtpStorage(server.url())
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	defer fs.Close()
+	if err := fs.Store("a/1"+archiveExt, bytes.NewBufferString("archive")); err == nil {
+		t.Errorf("Store succeeded although the server has fewer bytes")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.files) != 0 {
+		t.Errorf("Files left on the server: %v", server.files)
+	}
+	if count(server.commands, "RNTO") != 0 {
+		t.Errorf("Incomplete upload renamed into place")
+	}
+}
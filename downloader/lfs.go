@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// With -lfs, the Git LFS objects of repositories using LFS are backed up,
+// too. This requires git-lfs to be installed. A plain clone only has the
+// pointer files, so all objects referenced from any branch or tag are
+// fetched into the clone. Like release assets, they do not change and are
+// not archived every time but stored once per destination in the layout
+// git-lfs uses, as <archive dir>/lfs/objects/<oid[0:2]>/<oid[2:4]>/<oid>.
+// The objects stored on each destination are kept in the hash
+// <namespace>:lfs:<destination>:<repo>, mapping oids to their names, which
+// -restore reads them back from.
+
+// usesLFS reports whether any branch or tag of the bare clone in dir routes
+// files through LFS.
+func usesLFS(dir string) (bool, error) {
+	refs, err := listRefs(dir)
+	if err != nil {
+		return false, err
+	}
+	seen := map[string]bool{}
+	args := []string{"grep", "-q", "-e", "filter=lfs"}
+	for _, sha := range refs {
+		if !seen[sha] {
+			seen[sha] = true
+			args = append(args, sha)
+		}
+	}
+	if len(seen) == 0 {
+		return false, nil
+	}
+	// Without glob magic, * matches across directories.
+	args = append(args, "--", ".gitattributes", "*/.gitattributes")
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	err = cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		if status, ok := ee.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 1 {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("Could not look for LFS attributes: %s", err)
+	}
+	return true, nil
+}
+
+// backupLFS fetches the LFS objects of repo into its bare clone in dir and
+// stores those not stored before on all dests. The objects are removed from
+// the clone afterwards, so they are not archived again.
+func backupLFS(conn redis.Conn, repo, cloneURL, dir string, cred *credential, dests []*destination) error {
+	ok, err := usesLFS(dir)
+	if err != nil || !ok {
+		return err
+	}
+	_, env, err := cred.gitEnv(cloneURL)
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", "lfs", "fetch", "--all", "origin")
+	cmd.Dir = dir
+	cmd.Env = gitEnviron(env)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not fetch LFS objects: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	lfsDir := filepath.Join(dir, "lfs")
+	defer os.RemoveAll(lfsDir)
+	if len(dests) == 0 {
+		return nil
+	}
+
+	adir, err := archiveDir(repo)
+	if err != nil {
+		return err
+	}
+	objects := filepath.Join(lfsDir, "objects")
+	n := 0
+	err = filepath.Walk(objects, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == objects {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(lfsDir, p)
+		if err != nil {
+			return err
+		}
+		stored, err := storeOnce(conn, "lfs", repo, info.Name(), path.Join(adir, "lfs", filepath.ToSlash(rel)), dests, func() (io.ReadCloser, error) {
+			return os.Open(p)
+		})
+		if err != nil {
+			return fmt.Errorf("Could not store LFS object %s: %s", info.Name(), err)
+		}
+		if stored {
+			n++
+		}
+		return nil
+	})
+	if n > 0 {
+		log.Printf("Stored %d LFS objects of %s", n, repo)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// localStorage stores archives in a local directory, e.g. a mounted NAS
+// share (file:///mnt/nas/backups).
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(u *url.URL) (*localStorage, error) {
+	if u.Path == "" {
+		return nil, fmt.Errorf("file destinations need a path")
+	}
+	if err := os.MkdirAll(u.Path, os.FileMode(0700)); err != nil {
+		return nil, err
+	}
+	return &localStorage{root: u.Path}, nil
+}
+
+func (ls *localStorage) path(name string) string {
+	return filepath.Join(ls.root, filepath.FromSlash(name))
+}
+
+func (ls *localStorage) Store(name string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(ls.path(name)), os.FileMode(0700)); err != nil {
+		return err
+	}
+	tmp := ls.path(tempName(name))
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not verify upload: %s", err)
+	}
+	if info.Size() != n {
+		os.Remove(tmp)
+		return fmt.Errorf("Upload incomplete: sent %d bytes, file has %d", n, info.Size())
+	}
+	if err := os.Rename(tmp, ls.path(name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (ls *localStorage) List(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(ls.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && isArchive(info.Name()) {
+			names = append(names, dir+"/"+info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (ls *localStorage) Fetch(name string, w io.Writer) error {
+	f, err := os.Open(ls.path(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (ls *localStorage) Remove(name string) error {
+	return os.Remove(ls.path(name))
+}
+
+func (ls *localStorage) Close() error {
+	return nil
+}
@@ -2,81 +2,159 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
-	"encoding/base64"
 	"flag"
-	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/dutchcoders/goftp"
 	"github.com/garyburd/redigo/redis"
 	"github.com/surma-dump/github-backup/common"
 )
 
 var (
-	sshKey    = flag.String("key", "", "SSH key to use for cloning")
-	ftpURL    = flag.String("ftp", "", "FTP server to save backups to")
-	redisURL  = flag.String("redis", "", "Address of redis")
-	frequency = flag.Duration("frequency", 24*time.Hour, "Frequency of backups")
-	namespace = flag.String("namespace", "github-backup", "Database namespace")
-	force     = flag.Bool("force", false, "Force download")
-	help      = flag.Bool("help", false, "Show this help")
-)
+	sshKey       = flag.String("key", "", "Deprecated: base64 encoded SSH key, visible in the process list. Use -key-file or $"+sshKeyEnv)
+	keyFile      = flag.String("key-file", "", "SSH key to use for cloning")
+	credsFile    = flag.String("credentials", "", "JSON file with SSH keys or HTTPS tokens per host, owner or repository")
+	knownHosts   = flag.String("known-hosts", "", "known_hosts file to verify SSH host keys with (default: GitHub's published keys)")
+	ftpURL       = flag.String("ftp", "", "Deprecated alias for -dest")
+	redisURL     = flag.String("redis", "", "Address of redis")
+	frequency    = flag.Duration("frequency", 24*time.Hour, "Frequency of backups")
+	namespace    = flag.String("namespace", "github-backup", "Database namespace")
+	force        = flag.Bool("force", false, "Force download")
+	retries      = flag.Int("retries", 3, "Number of attempts per upload")
+	keep         = flag.Int("keep", 0, "Number of archives to keep per repository (0 keeps all)")
+	tombAfter    = flag.Int("tombstone-after", 3, "Number of runs in a row a repository has to be missing upstream before it is considered deleted")
+	release      = flag.String("release", "", "Release the tombstone of a deleted repository, so it is cloned and pruned again, and exit")
+	restore      = flag.String("restore", "", "Push an archived repository and its LFS objects from the first readable -dest to -restore-to and exit")
+	restoreTo    = flag.String("restore-to", "", "Git url of the empty repository -restore pushes to")
+	snapshot     = flag.String("snapshot", "", "Archive -restore uses (default: the latest one)")
+	notifyURL    = flag.String("notify", "", "URL to POST a JSON message to when history was rewritten or refs were deleted")
+	metadata     = flag.Bool("metadata", false, "Export issues, pull requests, comments and labels of GitHub repositories into the archives")
+	metadataFull = flag.Duration("metadata-full", 7*24*time.Hour, "Interval of full metadata exports, exports in between only contain changes")
+	wikis        = flag.Bool("wikis", false, "Add the wikis of repositories to their archives")
+	releases     = flag.Bool("releases", false, "Add release metadata to the archives and store release assets")
+	settings     = flag.Bool("settings", false, "Add the settings of GitHub repositories to their archives")
+	lfs          = flag.Bool("lfs", false, "Store the Git LFS objects of repositories using LFS (requires git-lfs)")
+	githubAPI    = flag.String("github-api", defaultGithubAPI, "Base url of the GitHub API")
+	masterKey    = flag.String("master-key", "", "Comma separated base64 encoded keys secrets in the database are encrypted with, the first one is used for new secrets (default $"+common.MasterKeyEnv+")")
+	clientID     = flag.String("id", "", "App ID of GitHub app, needed to refresh OAuth tokens")
+	clientSec    = flag.String("secret", "", "Secret of GitHub app, needed to refresh OAuth tokens")
+	help         = flag.Bool("help", false, "Show this help")
 
-var (
-	badCharacters = regexp.MustCompilePOSIX("[/@:!?*\\&]")
+	destURLs    stringList
+	credentials credentialStore
+	sealer      *common.Sealer
 )
 
+func init() {
+	flag.Var(&destURLs, "dest", "Destination to save backups to (ftp://, ftps://, sftp://, webdav://, davs://, file://, gitea+https:// or mirror+<git url>), may be given multiple times")
+}
+
 func main() {
 	flag.Parse()
 	if *help {
 		flag.PrintDefaults()
 		return
 	}
-	if *ftpURL == "" || *redisURL == "" {
-		log.Fatalf("-ftp and -redis have to be set")
+	if *release != "" {
+		if *redisURL == "" {
+			log.Fatalf("-redis has to be set")
+		}
+		if err := common.CheckRedis(*redisURL); err != nil {
+			log.Fatalf("Could not connect to redis: %s", err)
+		}
+		pool := common.CreateRedisPool(*redisURL)
+		defer pool.Close()
+		conn := pool.Get()
+		defer conn.Close()
+		if err := releaseTombstone(conn, *release); err != nil {
+			log.Fatalf("Could not release tombstone: %s", err)
+		}
+		log.Printf("Released tombstone of %s", *release)
+		return
+	}
+	if *ftpURL != "" {
+		destURLs = append(destURLs, *ftpURL)
+	}
+	if len(destURLs) == 0 || *redisURL == "" {
+		log.Fatalf("-dest and -redis have to be set")
 	}
 
 	if *sshKey != "" {
-		if err := addSSHKey(*sshKey); err != nil {
-			log.Fatalf("Could not add SSH key: %s", err)
+		log.Printf("-key is deprecated as it exposes the key in the process list, use -key-file or $%s", sshKeyEnv)
+	}
+	// The decoded key must not outlive the process, which only ends through
+	// a signal or fatalf.
+	cleanupSSHOnSignal()
+	if err := setupSSH(*keyFile, *sshKey, *knownHosts); err != nil {
+		fatalf("Could not set up SSH: %s", err)
+	}
+	defer cleanupSSH()
+	if *credsFile != "" {
+		var err error
+		if credentials, err = loadCredentials(*credsFile); err != nil {
+			fatalf("Could not load credentials: %s", err)
+		}
+	}
+
+	if *masterKey != "" || os.Getenv(common.MasterKeyEnv) != "" {
+		var err error
+		if sealer, err = common.NewSealer(*masterKey); err != nil {
+			fatalf("Invalid master key: %s", err)
 		}
 	}
 
 	if err := common.CheckRedis(*redisURL); err != nil {
-		log.Fatalf("Could not connect to redis: %s", err)
+		fatalf("Could not connect to redis: %s", err)
 	}
 	pool := common.CreateRedisPool(*redisURL)
 	defer pool.Close()
 
-	ftpConn, ftpURL, err := connectFtp(*ftpURL)
-	if err != nil {
-		log.Fatalf("Could not connect to FTP server: %s", err)
+	dests := []*destination{}
+	mirrors := map[string]mirror{}
+	for _, s := range destURLs {
+		if isMirrorURL(s) {
+			m, err := openMirror(s)
+			if err != nil {
+				fatalf("Could not connect to mirror %s: %s", redactURL(s), err)
+			}
+			defer m.Close()
+			mirrors[redactURL(s)] = m
+			continue
+		}
+		dest, err := openDestination(s)
+		if err != nil {
+			fatalf("Could not connect to destination %s: %s", redactURL(s), err)
+		}
+		defer dest.Close()
+		dests = append(dests, dest)
 	}
-	defer ftpConn.Close()
-	if err := ftpConn.Cwd(ftpURL.Path); err != nil {
-		log.Fatalf("Could not cd to target directory: %s", err)
+	// The frontend needs the names of the destinations to move their records
+	// when a repository is renamed.
+	if err := registerDestinations(pool.Get(), dests); err != nil {
+		fatalf("Error saving destinations: %s", err)
 	}
-
-	m := &sync.Mutex{}
-	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-			m.Lock()
-			log.Printf("Noopping...")
-			ftpConn.Noop()
-			m.Unlock()
+	if *restore != "" {
+		if *restoreTo == "" {
+			fatalf("-restore-to has to be set")
 		}
-	}()
+		conn := pool.Get()
+		defer conn.Close()
+		if err := restoreRepository(conn, *restore, *restoreTo, *snapshot, dests); err != nil {
+			fatalf("Could not restore %s: %s", *restore, err)
+		}
+		log.Printf("Restored %s to %s", *restore, redactURL(*restoreTo))
+		return
+	}
+
 	for {
 		func() {
 			redisConn := pool.Get()
@@ -90,22 +168,13 @@ func main() {
 			}
 			*force = false
 
+			if err := flushNotifications(redisConn); err != nil {
+				log.Printf("Error sending queued notifications: %s", err)
+			}
 			log.Printf("Downloading all the repos...")
 			repos := repos(redisConn)
 			for _, repo := range repos {
-				log.Printf("Downloading %s...", repo)
-				safeName := badCharacters.ReplaceAllString(repo, "_")
-				r, err := downloadRepository(repo)
-				if err != nil {
-					log.Printf("Error downloading repository: %s", err)
-					continue
-				}
-
-				m.Lock()
-				if err := ftpConn.Stor(safeName+".tar.gz", r); err != nil {
-					log.Printf("Error uploading: %s", err)
-				}
-				m.Unlock()
+				backupRepository(redisConn, repo, dests, mirrors)
 			}
 			log.Printf("Finished.")
 			timestampLastRun(redisConn)
@@ -113,10 +182,137 @@ func main() {
 	}
 }
 
+// backupRepository clones repo, uploads an archive of it to all dests and
+// pushes it to all mirrors.
+func backupRepository(conn redis.Conn, repo string, dests []*destination, mirrors map[string]mirror) {
+	log.Printf("Downloading %s...", repo)
+	name, err := archivePath(repo, time.Now())
+	if err != nil {
+		log.Printf("Error naming archive: %s", err)
+		return
+	}
+	if buried, err := isTombstoned(conn, repo); err != nil || buried {
+		if err != nil {
+			log.Printf("Error checking tombstone: %s", err)
+		}
+		log.Printf("Skipping %s, it was deleted upstream", repo)
+		return
+	}
+	cred, cloneURL, err := resolveCredential(conn, repo)
+	if err != nil {
+		log.Printf("Error retrieving credentials, trying without: %s", err)
+	}
+	dir, err := downloadRepository(repo, cloneURL, cred)
+	recordStatus(conn, repo, "clone", err)
+	if err := noteCloneResult(conn, repo, cred, err); err != nil {
+		log.Printf("Error saving clone result: %s", err)
+	}
+	if err != nil {
+		log.Printf("Error downloading repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	history, err := checkHistory(conn, repo, filepath.Join(dir, bareName(repo)))
+	if err != nil {
+		log.Printf("Error checking history: %s", err)
+	}
+	if *lfs {
+		err := backupLFS(conn, repo, cloneURL, filepath.Join(dir, bareName(repo)), cred, dests)
+		recordStatus(conn, repo, "lfs", err)
+		if err != nil {
+			log.Printf("Error backing up LFS objects: %s", err)
+		}
+	}
+
+	if *wikis {
+		err := cloneWiki(conn, repo, cloneURL, dir, cred)
+		recordStatus(conn, repo, "wiki", err)
+		if err != nil {
+			log.Printf("Error downloading wiki: %s", err)
+		}
+	}
+	if *releases && onGithub(repo) {
+		err := backupReleases(conn, repo, dir, cred, dests)
+		recordStatus(conn, repo, "releases", err)
+		if err != nil {
+			log.Printf("Error backing up releases: %s", err)
+		}
+	}
+	if *settings && onGithub(repo) {
+		err := exportSettings(repo, dir, cred)
+		recordStatus(conn, repo, "settings", err)
+		if err != nil {
+			log.Printf("Error exporting settings: %s", err)
+		}
+	}
+
+	var export *metadataExport
+	if *metadata {
+		export, err = exportMetadata(conn, repo, dir, cred)
+		recordStatus(conn, repo, "metadata", err)
+		if err != nil {
+			log.Printf("Error exporting metadata: %s", err)
+		}
+	}
+
+	for mname, m := range mirrors {
+		err := m.Push(repo, filepath.Join(dir, bareName(repo)))
+		recordStatus(conn, repo, "mirror:"+mname, err)
+		if err != nil {
+			log.Printf("Error pushing to %s: %s", mname, err)
+		}
+	}
+
+	if len(dests) == 0 {
+		// Without archives, the clone itself is the new baseline.
+		if history != nil {
+			if err := history.commit(conn, repo); err != nil {
+				log.Printf("Error saving history: %s", err)
+			}
+		}
+		return
+	}
+	errs := uploadAll(dests, name, dir)
+	protected, err := protectedSnapshots(conn)
+	if err != nil {
+		log.Printf("Error reading protected snapshots, not pruning: %s", err)
+	}
+	stored := false
+	for _, dest := range dests {
+		err := errs[dest.name]
+		recordStatus(conn, repo, "dest:"+dest.name, err)
+		if err != nil {
+			log.Printf("Error uploading to %s: %s", dest.name, err)
+			continue
+		}
+		stored = true
+		if protected == nil {
+			continue
+		}
+		if err := prune(dest, path.Dir(name), *keep, protected); err != nil {
+			log.Printf("Error pruning old archives on %s: %s", dest.name, err)
+		}
+	}
+	if stored {
+		indexArchive(conn, repo, name)
+		if history != nil {
+			if err := history.commit(conn, repo); err != nil {
+				log.Printf("Error saving history: %s", err)
+			}
+		}
+		if export != nil {
+			if err := export.commit(conn, repo, name); err != nil {
+				log.Printf("Error saving metadata export state: %s", err)
+			}
+		}
+	}
+}
+
 func lastRun(conn redis.Conn) time.Time {
 	ok, err := redis.Bool(conn.Do("EXISTS", *namespace+":lastrun"))
 	if err != nil {
-		log.Fatalf("Error querying database: %s", err)
+		fatalf("Error querying database: %s", err)
 	}
 	if !ok {
 		return time.Unix(0, 0)
@@ -124,11 +320,11 @@ func lastRun(conn redis.Conn) time.Time {
 
 	ts, err := redis.String(conn.Do("GET", *namespace+":lastrun"))
 	if err != nil {
-		log.Fatalf("Error retrieving timestamp: %s", err)
+		fatalf("Error retrieving timestamp: %s", err)
 	}
 	t, err := time.Parse(time.RFC3339, ts)
 	if err != nil {
-		log.Fatalf("Error parsing timestamp: %s", err)
+		fatalf("Error parsing timestamp: %s", err)
 	}
 	return t
 }
@@ -136,7 +332,7 @@ func lastRun(conn redis.Conn) time.Time {
 func timestampLastRun(conn redis.Conn) {
 	_, err := conn.Do("SET", *namespace+":lastrun", time.Now().Format(time.RFC3339))
 	if err != nil {
-		log.Fatalf("Error writing timestamp: %s", err)
+		fatalf("Error writing timestamp: %s", err)
 	}
 }
 
@@ -146,60 +342,98 @@ func repos(conn redis.Conn) []string {
 		return []string{}
 	}
 	if err != nil {
-		log.Fatalf("Error retrieving repo list: %s", err)
+		fatalf("Error retrieving repo list: %s", err)
 	}
 	r := make([]string, 0, len(repos))
 	if err := redis.ScanSlice(repos, &r); err != nil {
-		log.Fatalf("Error parsing repo list: %s", err)
+		fatalf("Error parsing repo list: %s", err)
 	}
 	return r
 }
 
-func connectFtp(s string) (*goftp.FTP, *url.URL, error) {
-	ftpURL, err := url.Parse(s)
-	if err != nil {
-		log.Fatalf("Invalid ftp url: %s", err)
+// indexArchive records the archive at name as the latest snapshot of repo.
+func indexArchive(conn redis.Conn, repo, name string) {
+	if _, err := conn.Do("HSET", *namespace+":archive_index", repo, path.Dir(name)); err != nil {
+		log.Printf("Error saving archive index: %s", err)
 	}
-	if ftpURL.Scheme != "ftp" {
-		log.Fatalf("Unsupported target scheme %s", ftpURL.Scheme)
+	if _, err := conn.Do("RPUSH", *namespace+":snapshots:"+repo, name); err != nil {
+		log.Printf("Error saving snapshot list: %s", err)
 	}
-	if !strings.Contains(ftpURL.Host, ":") {
-		ftpURL.Host += ":21"
+}
+
+// upload archives dir and stores it under name, making up to attempts
+// attempts. Every attempt starts from scratch with a freshly created
+// archive, as the stream of an interrupted attempt cannot be rewound.
+func upload(dest storage, name, dir string, attempts int) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("Upload failed (%s), retrying (%d/%d)...", err, attempt, attempts)
+		}
+		var r io.ReadCloser
+		r, err = tarDir(dir)
+		if err != nil {
+			return err
+		}
+		err = dest.Store(name, r)
+		r.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// bareName returns the directory name of the bare clone of repo inside the
+// directory returned by downloadRepository. It is the name git would pick.
+func bareName(repo string) string {
+	repo = strings.TrimRight(repo, "/")
+	name := repo[strings.LastIndexAny(repo, "/:")+1:]
+	if !strings.HasSuffix(name, ".git") {
+		name += ".git"
 	}
+	return name
+}
 
-	ftp, err := goftp.Connect(ftpURL.Host)
+// downloadRepository clones the repository at path from cloneURL using cred
+// (which may be nil) and returns the directory containing the clone. The
+// caller is responsible for removing it.
+func downloadRepository(path, cloneURL string, cred *credential) (string, error) {
+	repo, err := ioutil.TempDir("", *namespace)
 	if err != nil {
-		return ftp, ftpURL, err
+		return "", err
 	}
-	if ftpURL.User == nil {
-		return ftp, ftpURL, err
+	if err := gitClone(repo, cloneURL, bareName(path), cred); err != nil {
+		os.RemoveAll(repo)
+		return "", err
 	}
-	user := ftpURL.User.Username()
-	pass, _ := ftpURL.User.Password()
-	return ftp, ftpURL, ftp.Login(user, pass)
+	return repo, nil
 }
 
-func downloadRepository(path string) (io.Reader, error) {
-	repo := os.TempDir() + *namespace
-	if err := os.MkdirAll(repo, os.FileMode(0700)); err != nil {
-		return nil, err
+// gitClone creates a bare clone of cloneURL named name in dir.
+func gitClone(dir, cloneURL, name string, cred *credential) error {
+	cloneURL, env, err := cred.gitEnv(cloneURL)
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.Command("git", "clone", "--bare", path)
-	cmd.Dir = repo
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", "clone", "--bare", cloneURL, name)
+	cmd.Dir = dir
+	cmd.Env = gitEnviron(env)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
 	if err := cmd.Run(); err != nil {
-		return nil, err
+		return classifyCloneError(err, stderr.String())
 	}
-
-	return tarDir(repo)
+	return nil
 }
 
-func tarDir(root string) (io.Reader, error) {
+// tarDir streams a gzipped tarball of root. Closing the returned reader
+// before EOF aborts the archiving.
+func tarDir(root string) (io.ReadCloser, error) {
 	r, w := io.Pipe()
 	go func() {
-		defer os.RemoveAll(root)
 		defer w.Close()
 		gzbuf := gzip.NewWriter(w)
 		defer gzbuf.Close()
@@ -245,44 +479,10 @@ func tarDir(root string) (io.Reader, error) {
 		}))
 		if err != nil {
 			log.Printf("Error creating archive: %s", err)
+			// Fail the reading side, so a truncated archive is never
+			// mistaken for a complete one.
+			w.CloseWithError(err)
 		}
 	}()
 	return r, nil
 }
-
-const (
-	sshConfig = `
-	IdentityFile /root/.ssh/github-backup
-	StrictHostKeyChecking no
-	`
-)
-
-func writeFile(path string, content []byte) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, os.FileMode(0700))
-	if err != nil {
-		return fmt.Errorf("Error creating file %s: %s", path, err)
-	}
-	defer f.Close()
-	if _, err := f.Write(content); err != nil {
-		return fmt.Errorf("Error writing file %s: %s", path, err)
-	}
-	return nil
-}
-
-func addSSHKey(encKey string) error {
-	key, err := base64.StdEncoding.DecodeString(encKey)
-	if err != nil {
-		return fmt.Errorf("Error decoding key: %s", err)
-	}
-	if err := os.MkdirAll("/root/.ssh", os.FileMode(0700)); err != nil {
-		return fmt.Errorf("Error creating .ssh folder: %s", err)
-	}
-
-	if err := writeFile("/root/.ssh/github-backup", key); err != nil {
-		return err
-	}
-	if err := writeFile("/root/.ssh/config", []byte(sshConfig)); err != nil {
-		return err
-	}
-	return nil
-}
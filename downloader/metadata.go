@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	gh "github.com/google/go-github/github"
+)
+
+// With -metadata, issues, pull requests, their comments and the labels of a
+// repository are exported from the GitHub API as JSON Lines into the
+// directory metadata/ next to the bare clone, so they end up in the same
+// archive.
+//
+// Exports are differential: every archive contains what changed since the
+// last full export, which is repeated every -metadata-full. The archive with
+// the full export is kept in the set <namespace>:protected_metadata, which
+// pruning skips, so the latest archive together with it is always complete.
+// The state of the exports is kept in the hash <namespace>:metadata:<repo>.
+
+const (
+	metadataDir      = "metadata"
+	defaultGithubAPI = "https://api.github.com/"
+)
+
+// metadataExport is the result of exporting the metadata of a repository.
+type metadataExport struct {
+	Full  bool      `json:"full"`
+	Since time.Time `json:"since,omitempty"`
+	Time  time.Time `json:"time"`
+	// Errors maps the files of lists that could not be exported to the
+	// error.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// unavailableError means GitHub does not offer a list for a repository,
+// e.g. the issues of a repository with issues disabled (410).
+type unavailableError struct {
+	err error
+}
+
+func (ue unavailableError) Error() string {
+	return ue.err.Error()
+}
+
+// tokenTransport authenticates requests to host with an OAuth token.
+// Requests to other hosts, e.g. redirects to downloads, are sent without.
+type tokenTransport struct {
+	host, token string
+}
+
+func (tt tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != tt.host {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+	req := *r
+	req.Header = http.Header{}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "token "+tt.token)
+	return http.DefaultTransport.RoundTrip(&req)
+}
+
+// githubHTTPClient returns an HTTP client sending token to host, or the
+// default client if token is empty.
+func githubHTTPClient(host, token string) *http.Client {
+	if token == "" {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: tokenTransport{host, token}}
+}
+
+// newGithubClient returns a client for the API at -github-api, using token
+// if it is not empty.
+func newGithubClient(token string) (*gh.Client, error) {
+	base, err := url.Parse(*githubAPI)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid GitHub API url: %s", err)
+	}
+	client := gh.NewClient(githubHTTPClient(base.Host, token))
+	if base.Path == "" || base.Path[len(base.Path)-1] != '/' {
+		base.Path += "/"
+	}
+	client.BaseURL = base
+	return client, nil
+}
+
+// onGithub reports whether repo is hosted on GitHub, or, if -github-api is
+// set, on the GitHub Enterprise instance it points to.
+func onGithub(repo string) bool {
+	if *githubAPI != defaultGithubAPI {
+		return true
+	}
+	host, _, _, err := splitRepoURL(repo)
+	return err == nil && host == "github.com"
+}
+
+// githubName returns the owner and name of the GitHub repository repo.
+func githubName(repo string) (owner, name string, err error) {
+	_, _, segments, err := splitRepoURL(repo)
+	if err != nil {
+		return "", "", err
+	}
+	if len(segments) != 2 {
+		return "", "", fmt.Errorf("%s is not a GitHub repository url", repo)
+	}
+	return segments[0], strings.TrimSuffix(segments[1], ".git"), nil
+}
+
+// exportList writes all items listed at endpoint to the JSON Lines file
+// name in dir. If stop is not nil, listing ends at the first item for which
+// it returns true.
+func exportList(ghAPI *gh.Client, endpoint string, query url.Values, dir, name string, stop func(json.RawMessage) bool) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	query.Set("per_page", "100")
+	page := 1
+list:
+	for page != 0 {
+		query.Set("page", fmt.Sprintf("%d", page))
+		req, err := ghAPI.NewRequest("GET", endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		items := []json.RawMessage{}
+		resp, err := ghAPI.Do(req, &items)
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone) {
+			return unavailableError{fmt.Errorf("%s is not available: %s", endpoint, resp.Status)}
+		}
+		if err != nil {
+			return fmt.Errorf("Could not list %s: %s", endpoint, err)
+		}
+		for _, item := range items {
+			if stop != nil && stop(item) {
+				break list
+			}
+			w.Write(item)
+			w.WriteString("\n")
+		}
+		page = resp.NextPage
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// updatedBefore returns a function reporting whether an item was last
+// updated before t.
+func updatedBefore(t time.Time) func(json.RawMessage) bool {
+	return func(item json.RawMessage) bool {
+		v := struct {
+			UpdatedAt time.Time `json:"updated_at"`
+		}{}
+		return json.Unmarshal(item, &v) == nil && v.UpdatedAt.Before(t)
+	}
+}
+
+// exportMetadata exports the metadata of repo into dir using the token of
+// cred, if it has one. It returns nil if repo is not hosted on GitHub.
+// Lists that are not available, like the issues of repositories with issues
+// disabled, are left empty. Other failures are recorded in export.json as
+// well, but the export is not returned, so it never becomes the base of
+// later ones.
+func exportMetadata(conn redis.Conn, repo, dir string, cred *credential) (*metadataExport, error) {
+	if !onGithub(repo) {
+		return nil, nil
+	}
+	owner, name, err := githubName(repo)
+	if err != nil {
+		return nil, err
+	}
+	token := ""
+	if cred != nil {
+		token = cred.token
+	}
+	ghAPI, err := newGithubClient(token)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &metadataExport{Time: time.Now().UTC()}
+	last, err := redis.String(conn.Do("HGET", *namespace+":metadata:"+repo, "full_time"))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if last != "" {
+		export.Since, _ = time.Parse(time.RFC3339, last)
+	}
+	export.Full = export.Since.IsZero() || export.Time.Sub(export.Since) > *metadataFull
+	if export.Full {
+		export.Since = time.Time{}
+	}
+
+	mdir := filepath.Join(dir, metadataDir)
+	if err := os.MkdirAll(mdir, 0755); err != nil {
+		return nil, err
+	}
+	withSince := func(q url.Values) url.Values {
+		if !export.Full {
+			q.Set("since", export.Since.Format(time.RFC3339))
+		}
+		return q
+	}
+	base := "repos/" + owner + "/" + name
+	lists := []struct {
+		endpoint, file string
+		query          url.Values
+		stop           func(json.RawMessage) bool
+	}{
+		// Pull requests are listed as issues, too.
+		{base + "/issues", "issues.jsonl", withSince(url.Values{"state": {"all"}, "sort": {"updated"}, "direction": {"asc"}}), nil},
+		{base + "/issues/comments", "issue_comments.jsonl", withSince(url.Values{}), nil},
+		{base + "/pulls/comments", "review_comments.jsonl", withSince(url.Values{}), nil},
+		// Pull requests can not be filtered by time, so they are listed
+		// newest first until an older one shows up.
+		{base + "/pulls", "pulls.jsonl", url.Values{"state": {"all"}, "sort": {"updated"}, "direction": {"desc"}}, updatedBefore(export.Since)},
+		{base + "/labels", "labels.jsonl", url.Values{}, nil},
+	}
+	failed := []string{}
+	for _, l := range lists {
+		err := exportList(ghAPI, l.endpoint, l.query, mdir, l.file, l.stop)
+		if err == nil {
+			continue
+		}
+		if export.Errors == nil {
+			export.Errors = map[string]string{}
+		}
+		export.Errors[l.file] = err.Error()
+		if _, ok := err.(unavailableError); !ok {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(mdir, "export.json"), data, 0644); err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return export, nil
+}
+
+// commit records that export was stored in the archive name. Full exports
+// replace the previous one as the base of differential exports.
+func (me *metadataExport) commit(conn redis.Conn, repo, name string) error {
+	if !me.Full {
+		return nil
+	}
+	key := *namespace + ":metadata:" + repo
+	old, err := redis.String(conn.Do("HGET", key, "full_snapshot"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if _, err := conn.Do("SADD", *namespace+":protected_metadata", name); err != nil {
+		return err
+	}
+	if _, err := conn.Do("HMSET", key, "full_time", me.Time.Format(time.RFC3339), "full_snapshot", name); err != nil {
+		return err
+	}
+	if old == "" {
+		return nil
+	}
+	_, err = conn.Do("SREM", *namespace+":protected_metadata", old)
+	return err
+}
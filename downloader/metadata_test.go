@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a redis.Conn keeping strings, hashes, sets and lists in
+// memory.
+type fakeConn struct {
+	values map[string]string
+	hashes map[string]map[string]string
+	sets   map[string]map[string]bool
+	lists  map[string][]string
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		values: map[string]string{},
+		hashes: map[string]map[string]string{},
+		sets:   map[string]map[string]bool{},
+		lists:  map[string][]string{},
+	}
+}
+
+func (fc *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	s := make([]string, len(args))
+	for i, a := range args {
+		if b, ok := a.([]byte); ok {
+			s[i] = string(b)
+		} else {
+			s[i] = fmt.Sprint(a)
+		}
+	}
+	switch cmd {
+	case "GET":
+		v, ok := fc.values[s[0]]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "SET":
+		fc.values[s[0]] = s[1]
+		return "OK", nil
+	case "LINDEX":
+		l := fc.lists[s[0]]
+		var i int
+		fmt.Sscan(s[1], &i)
+		if i < 0 {
+			i += len(l)
+		}
+		if i < 0 || i >= len(l) {
+			return nil, nil
+		}
+		return []byte(l[i]), nil
+	case "LPOP":
+		l := fc.lists[s[0]]
+		if len(l) == 0 {
+			return nil, nil
+		}
+		fc.lists[s[0]] = l[1:]
+		return []byte(l[0]), nil
+	case "HGET":
+		v, ok := fc.hashes[s[0]][s[1]]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "HEXISTS":
+		if _, ok := fc.hashes[s[0]][s[1]]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "HGETALL":
+		values := []interface{}{}
+		for k, v := range fc.hashes[s[0]] {
+			values = append(values, []byte(k), []byte(v))
+		}
+		return values, nil
+	case "HDEL":
+		n := 0
+		for _, f := range s[1:] {
+			if _, ok := fc.hashes[s[0]][f]; ok {
+				delete(fc.hashes[s[0]], f)
+				n++
+			}
+		}
+		return int64(n), nil
+	case "HINCRBY":
+		if fc.hashes[s[0]] == nil {
+			fc.hashes[s[0]] = map[string]string{}
+		}
+		var n, by int64
+		fmt.Sscan(fc.hashes[s[0]][s[1]], &n)
+		fmt.Sscan(s[2], &by)
+		fc.hashes[s[0]][s[1]] = fmt.Sprint(n + by)
+		return n + by, nil
+	case "RPUSH":
+		fc.lists[s[0]] = append(fc.lists[s[0]], s[1:]...)
+		return int64(len(fc.lists[s[0]])), nil
+	case "LRANGE":
+		// Only whole lists are supported.
+		values := []interface{}{}
+		for _, v := range fc.lists[s[0]] {
+			values = append(values, []byte(v))
+		}
+		return values, nil
+	case "HMSET", "HSET":
+		if fc.hashes[s[0]] == nil {
+			fc.hashes[s[0]] = map[string]string{}
+		}
+		for i := 1; i+1 < len(s); i += 2 {
+			fc.hashes[s[0]][s[i]] = s[i+1]
+		}
+		return "OK", nil
+	case "SADD":
+		if fc.sets[s[0]] == nil {
+			fc.sets[s[0]] = map[string]bool{}
+		}
+		for _, m := range s[1:] {
+			fc.sets[s[0]][m] = true
+		}
+		return int64(len(s) - 1), nil
+	case "SREM":
+		for _, m := range s[1:] {
+			delete(fc.sets[s[0]], m)
+		}
+		return int64(len(s) - 1), nil
+	}
+	return nil, fmt.Errorf("Unexpected command %s", cmd)
+}
+
+func (fc *fakeConn) Close() error                               { return nil }
+func (fc *fakeConn) Err() error                                 { return nil }
+func (fc *fakeConn) Send(cmd string, args ...interface{}) error { return fmt.Errorf("Not supported") }
+func (fc *fakeConn) Flush() error                               { return nil }
+func (fc *fakeConn) Receive() (interface{}, error)              { return nil, fmt.Errorf("Not supported") }
+
+// fakeAPI serves pages of items per path, linking them like the GitHub API
+// does, and records the queries it was sent.
+type fakeAPI struct {
+	*httptest.Server
+	pages map[string][][]map[string]interface{}
+	// status makes paths fail with the given status code.
+	status map[string]int
+
+	m       sync.Mutex
+	queries map[string][]string
+}
+
+func newFakeAPI(pages map[string][][]map[string]interface{}) *fakeAPI {
+	fa := &fakeAPI{pages: pages, status: map[string]int{}, queries: map[string][]string{}}
+	fa.Server = httptest.NewServer(http.HandlerFunc(fa.serve))
+	return fa
+}
+
+func (fa *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	fa.m.Lock()
+	fa.queries[r.URL.Path] = append(fa.queries[r.URL.Path], r.URL.RawQuery)
+	fa.m.Unlock()
+
+	if status := fa.status[r.URL.Path]; status != 0 {
+		http.Error(w, `{"message": "error"}`, status)
+		return
+	}
+	pages := fa.pages[r.URL.Path]
+	page := 1
+	fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+	items := []map[string]interface{}{}
+	if page <= len(pages) {
+		items = pages[page-1]
+	}
+	if page < len(pages) {
+		q := r.URL.Query()
+		q.Set("page", fmt.Sprint(page+1))
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s?%s>; rel="next"`, fa.URL, r.URL.Path, q.Encode()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// useAPI points -github-api at fa until the returned function is called.
+func useAPI(fa *fakeAPI) func() {
+	old := *githubAPI
+	*githubAPI = fa.URL + "/"
+	return func() {
+		*githubAPI = old
+		fa.Close()
+	}
+}
+
+func readLines(t *testing.T, name string) []map[string]interface{} {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	items := []map[string]interface{}{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		item := map[string]interface{}{}
+		if err := json.Unmarshal(s.Bytes(), &item); err != nil {
+			t.Fatalf("Invalid line %q: %s", s.Text(), err)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func item(id int, updated time.Time) map[string]interface{} {
+	return map[string]interface{}{"id": id, "updated_at": updated.Format(time.RFC3339)}
+}
+
+func TestExportListFollowsLinks(t *testing.T) {
+	now := time.Now().UTC()
+	fa := newFakeAPI(map[string][][]map[string]interface{}{
+		"/repos/a/b/labels": {{item(1, now), item(2, now)}, {item(3, now)}, {item(4, now)}},
+	})
+	defer useAPI(fa)()
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ghAPI, err := newGithubClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exportList(ghAPI, "repos/a/b/labels", url.Values{}, dir, "labels.jsonl", nil); err != nil {
+		t.Fatal(err)
+	}
+	items := readLines(t, filepath.Join(dir, "labels.jsonl"))
+	if len(items) != 4 {
+		t.Fatalf("Expected 4 items from 3 pages, got %d", len(items))
+	}
+	for i, it := range items {
+		if it["id"] != float64(i+1) {
+			t.Errorf("Item %d has id %v", i, it["id"])
+		}
+	}
+	if n := len(fa.queries["/repos/a/b/labels"]); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+}
+
+func TestExportMetadata(t *testing.T) {
+	now := time.Now().UTC()
+	since := now.Add(-time.Hour)
+	tests := []struct {
+		name     string
+		fullTime time.Time
+		full     bool
+	}{
+		{"first", time.Time{}, true},
+		{"incremental", since, false},
+		{"due", now.Add(-*metadataFull - time.Hour), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fa := newFakeAPI(map[string][][]map[string]interface{}{
+				"/repos/a/b/issues": {{item(1, now)}},
+				"/repos/a/b/pulls": {
+					{item(10, now), item(11, since.Add(time.Minute))},
+					{item(12, since.Add(-time.Minute)), item(13, since.Add(-2*time.Minute))},
+					{item(14, since.Add(-time.Hour))},
+				},
+			})
+			defer useAPI(fa)()
+			dir, err := ioutil.TempDir("", "metadata")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			conn := newFakeConn()
+			key := *namespace + ":metadata:git@github.com:a/b.git"
+			if !test.fullTime.IsZero() {
+				conn.hashes[key] = map[string]string{
+					"full_time":     test.fullTime.Format(time.RFC3339),
+					"full_snapshot": "old.tar.gz",
+				}
+			}
+			export, err := exportMetadata(conn, "git@github.com:a/b.git", dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if export.Full != test.full {
+				t.Fatalf("Expected full export %v, got %v", test.full, export.Full)
+			}
+
+			for _, p := range []string{"/repos/a/b/issues", "/repos/a/b/issues/comments", "/repos/a/b/pulls/comments"} {
+				qs := fa.queries[p]
+				if len(qs) == 0 {
+					t.Fatalf("%s was not requested", p)
+				}
+				hasSince := strings.Contains(qs[0], "since=")
+				if hasSince == test.full {
+					t.Errorf("%s: since sent %v on full export %v (%s)", p, hasSince, test.full, qs[0])
+				}
+				if !test.full && !strings.Contains(qs[0], "since="+strings.Replace(test.fullTime.Format(time.RFC3339), ":", "%3A", -1)) {
+					t.Errorf("%s: since does not match the last full export: %s", p, qs[0])
+				}
+			}
+
+			pulls := readLines(t, filepath.Join(dir, metadataDir, "pulls.jsonl"))
+			want, pages := 5, 3
+			if !test.full {
+				// Listing stops at the first pull request older than the
+				// last full export.
+				want, pages = 2, 2
+			}
+			if len(pulls) != want {
+				t.Errorf("Expected %d pull requests, got %d", want, len(pulls))
+			}
+			if n := len(fa.queries["/repos/a/b/pulls"]); n != pages {
+				t.Errorf("Expected %d pages of pull requests to be requested, got %d", pages, n)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, metadataDir, "export.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := &metadataExport{}
+			if err := json.Unmarshal(data, written); err != nil {
+				t.Fatal(err)
+			}
+			if written.Full != test.full {
+				t.Errorf("export.json says full %v", written.Full)
+			}
+
+			if err := export.commit(conn, "git@github.com:a/b.git", "new.tar.gz"); err != nil {
+				t.Fatal(err)
+			}
+			protected := conn.sets[*namespace+":protected_metadata"]
+			if test.full && (!protected["new.tar.gz"] || protected["old.tar.gz"]) {
+				t.Errorf("Full export did not replace the protected base: %v", protected)
+			}
+			if !test.full && (len(protected) != 0 || conn.hashes[key]["full_snapshot"] != "old.tar.gz") {
+				t.Errorf("Incremental export changed the base: %v %v", protected, conn.hashes[key])
+			}
+		})
+	}
+}
+
+func TestExportMetadataSections(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		failed bool
+	}{
+		{"issues disabled", http.StatusGone, false},
+		{"not found", http.StatusNotFound, false},
+		{"server error", http.StatusBadGateway, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now().UTC()
+			fa := newFakeAPI(map[string][][]map[string]interface{}{
+				"/repos/a/b/pulls":  {{item(1, now)}},
+				"/repos/a/b/labels": {{item(2, now)}},
+			})
+			fa.status["/repos/a/b/issues"] = test.status
+			defer useAPI(fa)()
+			dir, err := ioutil.TempDir("", "metadata")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			export, err := exportMetadata(newFakeConn(), "git@github.com:a/b.git", dir, nil)
+			if (err != nil) != test.failed {
+				t.Fatalf("exportMetadata returned %v", err)
+			}
+			if (export == nil) != test.failed {
+				t.Errorf("Export returned: %v", export != nil)
+			}
+			for _, name := range []string{"pulls.jsonl", "labels.jsonl"} {
+				if n := len(readLines(t, filepath.Join(dir, metadataDir, name))); n != 1 {
+					t.Errorf("%s has %d items, expected 1", name, n)
+				}
+			}
+			if n := len(readLines(t, filepath.Join(dir, metadataDir, "issues.jsonl"))); n != 0 {
+				t.Errorf("issues.jsonl has %d items", n)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, metadataDir, "export.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := &metadataExport{}
+			if err := json.Unmarshal(data, written); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := written.Errors["issues.jsonl"]; !ok || len(written.Errors) != 1 {
+				t.Errorf("export.json has errors %v, expected one for issues.jsonl", written.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGiteaName(t *testing.T) {
+	tests := []struct {
+		repo, owner, name string
+	}{
+		{"git@github.com:owner/repo.git", "github_2Ecom", "owner__repo"},
+		{"git@github.com:owner/repo", "github_2Ecom", "owner__repo_0"},
+		{"git@host:/srv/a.git", "host", "_2F__srv__a"},
+		{"git@host:srv/a.git", "host", "srv__a"},
+		{"/srv/a.git", "local_repos", "_2F__srv__a"},
+		{"git@local:srv/a.git", "local", "srv__a"},
+		{"git@host:a/b_c", "host", "a__b_5Fc_0"},
+		{"git@host:a_b/c", "host", "a_5Fb__c_0"},
+		{"git@a-b:x.git", "a-b", "x"},
+		{"git@a-.b:x.git", "a_2D_2Eb", "x"},
+		// Gitea rejects owners starting or ending with special characters.
+		{"git@.local:x.git", "2Elocal-ab4cdf3c", "x"},
+		{"git@-host-:x.git", "2Dhost_2D-ad4f1f01", "x"},
+		// Too long names are shortened.
+		{"git@" + strings.Repeat("h", 50) + ".example.com:x.git", strings.Repeat("h", 31) + "-e9cb66c2", "x"},
+		{"git@host:" + strings.Repeat("seg/", 30) + "x.git", "host", strings.Repeat("seg__", 18) + "s-233e8744"},
+	}
+	seen := map[string]string{}
+	for _, test := range tests {
+		owner, name, err := giteaName(test.repo)
+		if err != nil {
+			t.Errorf("giteaName(%q) failed: %s", test.repo, err)
+			continue
+		}
+		if owner != test.owner || name != test.name {
+			t.Errorf("giteaName(%q) = %s/%s, expected %s/%s", test.repo, owner, name, test.owner, test.name)
+		}
+		if !giteaValid(owner) || len(owner) > giteaOwnerMax || len(name) > giteaNameMax {
+			t.Errorf("giteaName(%q) = %s/%s, which Gitea rejects", test.repo, owner, name)
+		}
+		if other, ok := seen[owner+"/"+name]; ok {
+			t.Errorf("%s and %s are both mirrored as %s/%s", other, test.repo, owner, name)
+		}
+		seen[owner+"/"+name] = test.repo
+	}
+}
+
+func TestGiteaValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"github_2Ecom", true},
+		{"a-b", true},
+		{"local_repos", true},
+		{"local_", false},
+		{"_2Elocal", false},
+		{"a-", false},
+		{"a_-b", false},
+		{"a__b", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if valid := giteaValid(test.name); valid != test.valid {
+			t.Errorf("giteaValid(%q) = %v, expected %v", test.name, valid, test.valid)
+		}
+	}
+}
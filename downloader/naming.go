@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	archiveExt       = ".tar.gz"
+	timestampFormat  = "20060102T150405Z"
+	safeSegmentChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_."
+)
+
+const (
+	// localHost is the host of repositories given as a local path or file://
+	// url, as real hosts cannot be empty.
+	localHost = ""
+	// localDir is the directory of localHost. escapeSegment never returns a
+	// leading dot, so it cannot clash with the directory of a real host.
+	localDir = ".local"
+	// absSegment is the segment archive directories of absolute paths start
+	// with after the host. It is the escaped form of "/", which a path
+	// segment cannot contain.
+	absSegment = "%2F"
+)
+
+// homeSchemes are the url schemes whose paths may start with /~ to be
+// relative to a home directory, like scp style paths without a leading /.
+var homeSchemes = map[string]bool{"ssh": true, "git": true, "git+ssh": true, "ssh+git": true}
+
+// splitRepoURL splits a git URL into its host and path segments. Both URL
+// style (ssh://git@host:22/owner/repo.git) and scp style
+// (git@host:owner/repo.git) addresses are supported. abs tells absolute
+// paths (git@host:/srv/repo.git, ssh://host/srv/repo.git, /srv/repo.git)
+// from paths relative to the user's home or the working directory
+// (git@host:repo.git, ssh://host/~/repo.git, repo.git), which are different
+// repositories. Only scp style, ssh and git urls and local paths make this
+// distinction; https://host/owner/repo.git is never absolute. Local paths
+// and file:// urls have the host localHost.
+func splitRepoURL(repo string) (host string, abs bool, segments []string, err error) {
+	var p string
+	if strings.Contains(repo, "://") {
+		u, err := url.Parse(repo)
+		if err != nil {
+			return "", false, nil, fmt.Errorf("Invalid repository url %s: %s", repo, err)
+		}
+		host, p = u.Host, u.Path
+		if host == localHost && u.Scheme != "file" {
+			return "", false, nil, fmt.Errorf("Repository url %s has no host", repo)
+		}
+		switch {
+		case homeSchemes[u.Scheme] && strings.HasPrefix(p, "/~"):
+			p = p[1:]
+		case !homeSchemes[u.Scheme] && u.Scheme != "file":
+			// Paths of http(s) and other urls are not file system paths
+			// and always start with a /.
+			p = strings.TrimPrefix(p, "/")
+		}
+	} else if i := strings.Index(repo, ":"); i > 0 && !strings.Contains(repo[:i], "/") {
+		host, p = repo[:i], repo[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+		if host == localHost {
+			return "", false, nil, fmt.Errorf("Repository url %s has no host", repo)
+		}
+	} else {
+		host, p = localHost, repo
+	}
+	abs = strings.HasPrefix(p, "/")
+	if host != localHost && (p == "~" || strings.HasPrefix(p, "~/")) {
+		// On a server, ~/repo.git is the same as repo.git.
+		p = p[1:]
+	}
+
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	if len(segments) == 0 {
+		return "", false, nil, fmt.Errorf("Repository url %s has no path", repo)
+	}
+	return host, abs, segments, nil
+}
+
+// escapeSegment encodes s so it can be used as a single path segment on any
+// destination. Every byte outside of [A-Za-z0-9-_.] as well as a leading dot
+// is percent-encoded. As the percent sign itself is encoded, the mapping is
+// reversible and distinct inputs never yield the same segment.
+func escapeSegment(s string) string {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if strings.IndexByte(safeSegmentChars, c) >= 0 && !(i == 0 && c == '.') {
+			buf = append(buf, c)
+			continue
+		}
+		buf = append(buf, []byte(fmt.Sprintf("%%%02X", c))...)
+	}
+	return string(buf)
+}
+
+// archiveDir returns the directory all archives of the given repository are
+// stored in, following the layout <host>/<owner>/<repo>. Absolute paths
+// are stored below <host>/%2F, local repositories below .local.
+func archiveDir(repo string) (string, error) {
+	host, abs, segments, err := splitRepoURL(repo)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{escapeSegment(host)}
+	if host == localHost {
+		parts[0] = localDir
+	}
+	if abs {
+		parts = append(parts, absSegment)
+	}
+	for _, s := range segments {
+		parts = append(parts, escapeSegment(s))
+	}
+	return path.Join(parts...), nil
+}
+
+// archivePath returns the path of the archive of repo taken at time t.
+func archivePath(repo string, t time.Time) (string, error) {
+	dir, err := archiveDir(repo)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, t.UTC().Format(timestampFormat)+archiveExt), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEscapeSegment(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"repo.git", "repo.git"},
+		{"b_c", "b_c"},
+		{"a b", "a%20b"},
+		{"100%", "100%25"},
+		{".hidden", "%2Ehidden"},
+		{"a.", "a."},
+		{"..", "%2E."},
+		{"host:22", "host%3A22"},
+		{"/", "%2F"},
+	}
+	for _, test := range tests {
+		if out := escapeSegment(test.in); out != test.out {
+			t.Errorf("escapeSegment(%q) = %q, expected %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestArchiveDir(t *testing.T) {
+	tests := []struct {
+		repo, dir string
+	}{
+		{"git@github.com:owner/repo.git", "github.com/owner/repo.git"},
+		{"git@host:~/owner/repo.git", "host/owner/repo.git"},
+		{"ssh://git@host/~/owner/repo.git", "host/owner/repo.git"},
+		{"ssh://git@host:2222/~user/repo.git", "host%3A2222/%7Euser/repo.git"},
+		{"git@host:~user/repo.git", "host/%7Euser/repo.git"},
+		// These used to be flattened into the same name.
+		{"git@host:a/b_c", "host/a/b_c"},
+		{"git@host:a_b/c", "host/a_b/c"},
+		// Absolute paths are different repositories than relative ones.
+		{"git@host:/srv/a", "host/%2F/srv/a"},
+		{"git@host:srv/a", "host/srv/a"},
+		{"ssh://host/srv/a", "host/%2F/srv/a"},
+		// http(s) paths are never absolute.
+		{"https://github.com/owner/repo.git", "github.com/owner/repo.git"},
+		{"http://host:8080/srv/a", "host%3A8080/srv/a"},
+		// Local repositories cannot clash with a host named local.
+		{"/srv/a", ".local/%2F/srv/a"},
+		{"file:///srv/a", ".local/%2F/srv/a"},
+		{"srv/a", ".local/srv/a"},
+		{"git@local:srv/a", "local/srv/a"},
+		{"git@.local:srv/a", "%2Elocal/srv/a"},
+		{"git@host:owner/.git", "host/owner/%2Egit"},
+		{"git@host:owner/%2Egit", "host/owner/%252Egit"},
+	}
+	seen := map[string]string{}
+	for _, test := range tests {
+		dir, err := archiveDir(test.repo)
+		if err != nil {
+			t.Errorf("archiveDir(%q) failed: %s", test.repo, err)
+			continue
+		}
+		if dir != test.dir {
+			t.Errorf("archiveDir(%q) = %q, expected %q", test.repo, dir, test.dir)
+		}
+		if other, ok := seen[dir]; ok && !sameRepo(other, test.repo) {
+			t.Errorf("%s and %s share the directory %s", other, test.repo, dir)
+		}
+		seen[dir] = test.repo
+	}
+
+	for _, repo := range []string{"git@host:", "git@host:/", "file:///", "git@:repo.git", "ssh:///repo.git"} {
+		if _, err := archiveDir(repo); err == nil {
+			t.Errorf("archiveDir(%q) succeeded without a host or path", repo)
+		}
+	}
+}
+
+// sameRepo reports whether the urls a and b from TestArchiveDir denote the
+// same repository.
+func sameRepo(a, b string) bool {
+	same := [][]string{
+		{"git@github.com:owner/repo.git", "https://github.com/owner/repo.git"},
+		{"git@host:~/owner/repo.git", "ssh://git@host/~/owner/repo.git"},
+		{"git@host:/srv/a", "ssh://host/srv/a"},
+		{"/srv/a", "file:///srv/a"},
+	}
+	for _, s := range same {
+		if a == s[0] && b == s[1] || a == s[1] && b == s[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func TestArchivePath(t *testing.T) {
+	ts := time.Date(2015, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+	name, err := archivePath("git@github.com:owner/repo.git", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "github.com/owner/repo.git/20150304T040607Z" + archiveExt; name != expected {
+		t.Errorf("archivePath = %q, expected %q", name, expected)
+	}
+}
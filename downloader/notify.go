@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Messages for the url given with -notify are queued in the list
+// <namespace>:notifications and removed once they were delivered. Messages
+// the url does not accept stay queued and are sent again, in order, with the
+// next message and at the start of every run.
+
+// notification is the message POSTed to -notify. It has a text field, so it
+// can be sent to Slack-compatible webhooks directly.
+type notification struct {
+	Text   string     `json:"text"`
+	Repo   string     `json:"repo"`
+	Events []refEvent `json:"events,omitempty"`
+}
+
+// notify reports the ref events of repo.
+func notify(conn redis.Conn, repo string, events []refEvent) error {
+	lines := []string{fmt.Sprintf("History of %s changed, the previous state is kept in %s:", repo, events[0].Snapshot)}
+	for _, e := range events {
+		lines = append(lines, fmt.Sprintf("%s %s", e.Type, e.Ref))
+	}
+	return sendNotification(conn, repo, strings.Join(lines, "\n"), events)
+}
+
+// sendNotification queues a message about repo and sends all queued
+// messages. Only failing to queue it is an error, undelivered messages are
+// retried later.
+func sendNotification(conn redis.Conn, repo, text string, events []refEvent) error {
+	if *notifyURL == "" {
+		return nil
+	}
+	data, err := json.Marshal(notification{text, repo, events})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Do("RPUSH", *namespace+":notifications", data); err != nil {
+		return fmt.Errorf("Could not queue notification: %s", err)
+	}
+	if err := flushNotifications(conn); err != nil {
+		log.Printf("Notification about %s not sent yet: %s", repo, err)
+	}
+	return nil
+}
+
+// flushNotifications sends the queued messages in order. It stops at the
+// first one that fails.
+func flushNotifications(conn redis.Conn) error {
+	if *notifyURL == "" {
+		return nil
+	}
+	for {
+		data, err := redis.Bytes(conn.Do("LINDEX", *namespace+":notifications", 0))
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := postNotification(data); err != nil {
+			return err
+		}
+		if _, err := conn.Do("LPOP", *namespace+":notifications"); err != nil {
+			return err
+		}
+	}
+}
+
+// postNotification posts the JSON message data to -notify.
+func postNotification(data []byte) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(*notifyURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Could not send notification: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Could not send notification: %s", resp.Status)
+	}
+	return nil
+}
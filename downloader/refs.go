@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The refs of the last clone of a repository are kept in
+// <namespace>:refs:<repo>. Comparing them with a new clone reveals rewritten
+// history and deleted refs, which are recorded in the list
+// <namespace>:events:<repo>. The snapshot made before such an event is
+// protected from pruning. The refs are only updated once the new clone is
+// archived, so the baseline always matches an archive.
+
+const (
+	eventForcePush     = "force-push"
+	eventBranchDeleted = "branch-deleted"
+	eventTagDeleted    = "tag-deleted"
+	eventTagMoved      = "tag-moved"
+)
+
+type refEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Ref  string    `json:"ref"`
+	Old  string    `json:"old"`
+	New  string    `json:"new,omitempty"`
+	// Snapshot is the last archive containing the old state.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// listRefs returns the branches and tags of the bare clone in dir.
+func listRefs(dir string) (map[string]string, error) {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads", "refs/tags")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list refs: %s", err)
+	}
+	refs := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), " ", 2)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+// isAncestor reports whether old is an ancestor of new in the clone in dir.
+// Commits missing from the clone are not.
+func isAncestor(dir, old, new string) bool {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", old, new)
+	cmd.Dir = dir
+	return cmd.Run() == nil
+}
+
+// compareRefs returns the events that lead from the refs old to the refs new
+// of the clone in dir.
+func compareRefs(dir string, old, new map[string]string) []refEvent {
+	events := []refEvent{}
+	now := time.Now()
+	names := []string{}
+	for ref := range old {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	for _, ref := range names {
+		oldSHA := old[ref]
+		newSHA, ok := new[ref]
+		tag := strings.HasPrefix(ref, "refs/tags/")
+		switch {
+		case !ok && tag:
+			events = append(events, refEvent{Time: now, Type: eventTagDeleted, Ref: ref, Old: oldSHA})
+		case !ok:
+			events = append(events, refEvent{Time: now, Type: eventBranchDeleted, Ref: ref, Old: oldSHA})
+		case oldSHA == newSHA:
+		case tag:
+			events = append(events, refEvent{Time: now, Type: eventTagMoved, Ref: ref, Old: oldSHA, New: newSHA})
+		case !isAncestor(dir, oldSHA, newSHA):
+			events = append(events, refEvent{Time: now, Type: eventForcePush, Ref: ref, Old: oldSHA, New: newSHA})
+		}
+	}
+	return events
+}
+
+// historyCheck is the result of comparing a new clone with the refs of the
+// last archived one.
+type historyCheck struct {
+	refs   []byte
+	events []refEvent
+}
+
+// checkHistory compares the refs of the bare clone of repo in dir with those
+// of the last archived clone. If there are events, the latest snapshot,
+// which still has the old state, is protected right away. The events are
+// recorded and the refs become the new baseline only when the clone is
+// stored, see commit.
+func checkHistory(conn redis.Conn, repo, dir string) (*historyCheck, error) {
+	refs, err := listRefs(dir)
+	if err != nil {
+		return nil, err
+	}
+	hc := &historyCheck{}
+	if hc.refs, err = json.Marshal(refs); err != nil {
+		return nil, err
+	}
+	prevData, err := redis.Bytes(conn.Do("GET", *namespace+":refs:"+repo))
+	if err == redis.ErrNil {
+		return hc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prev := map[string]string{}
+	if err := json.Unmarshal(prevData, &prev); err != nil {
+		return nil, fmt.Errorf("Invalid refs of previous clone: %s", err)
+	}
+
+	hc.events = compareRefs(dir, prev, refs)
+	if len(hc.events) == 0 {
+		return hc, nil
+	}
+	snapshot, err := redis.String(conn.Do("LINDEX", *namespace+":snapshots:"+repo, -1))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if snapshot != "" {
+		if _, err := conn.Do("SADD", *namespace+":protected", snapshot); err != nil {
+			return nil, err
+		}
+	}
+	for i := range hc.events {
+		hc.events[i].Snapshot = snapshot
+	}
+	return hc, nil
+}
+
+// commit records and reports the events found and makes the checked refs
+// the baseline of repo. The refs come last, so events are found again
+// rather than lost if recording them fails.
+func (hc *historyCheck) commit(conn redis.Conn, repo string) error {
+	for _, e := range hc.events {
+		log.Printf("%s: %s %s (%s -> %s)", repo, e.Type, e.Ref, e.Old, e.New)
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Do("RPUSH", *namespace+":events:"+repo, data); err != nil {
+			return err
+		}
+	}
+	if len(hc.events) > 0 {
+		if err := notify(conn, repo, hc.events); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("SET", *namespace+":refs:"+repo, hc.refs)
+	return err
+}
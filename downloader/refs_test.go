@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompareRefs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	work := filepath.Join(tmp, "work")
+	os.Mkdir(work, 0755)
+	runGit(t, work, "init", "-q")
+	runGit(t, work, "symbolic-ref", "HEAD", "refs/heads/main")
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "a")
+	a := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "branch", "feature")
+	runGit(t, work, "branch", "ff")
+	runGit(t, work, "tag", "t1")
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "b")
+	b := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "tag", "t2")
+
+	bare := filepath.Join(tmp, "repo.git")
+	runGit(t, tmp, "clone", "-q", "--bare", work, bare)
+	old, err := listRefs(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// main is rewritten, t1 moves along, ff is fast-forwarded, feature and
+	// t2 are deleted and a new branch appears.
+	runGit(t, work, "reset", "-q", "--hard", a)
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "c")
+	c := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "tag", "-f", "t1")
+	runGit(t, work, "branch", "-f", "ff", b)
+	runGit(t, work, "branch", "-D", "feature")
+	runGit(t, work, "tag", "-d", "t2")
+	runGit(t, work, "branch", "new")
+	runGit(t, bare, "fetch", "-q", "--prune", "--prune-tags", work, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	new, err := listRefs(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type event struct {
+		Type, Ref, Old, New string
+	}
+	expected := []event{
+		{eventBranchDeleted, "refs/heads/feature", a, ""},
+		{eventForcePush, "refs/heads/main", b, c},
+		{eventTagMoved, "refs/tags/t1", a, c},
+		{eventTagDeleted, "refs/tags/t2", b, ""},
+	}
+	got := []event{}
+	for _, e := range compareRefs(bare, old, new) {
+		got = append(got, event{e.Type, e.Ref, e.Old, e.New})
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("compareRefs = %v, expected %v", got, expected)
+	}
+	if events := compareRefs(bare, new, new); len(events) != 0 {
+		t.Errorf("compareRefs of unchanged refs = %v", events)
+	}
+}
+
+func TestNotificationsAreQueued(t *testing.T) {
+	received := []notification{}
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		n := notification{}
+		json.NewDecoder(r.Body).Decode(&n)
+		received = append(received, n)
+	}))
+	defer server.Close()
+	oldURL := *notifyURL
+	defer func() { *notifyURL = oldURL }()
+	*notifyURL = server.URL
+
+	repo := "git@github.com:owner/repo.git"
+	conn := newFakeConn()
+	hc := &historyCheck{
+		refs:   []byte(`{"refs/heads/main":"b"}`),
+		events: []refEvent{{Type: eventForcePush, Ref: "refs/heads/main", Old: "a", New: "b", Snapshot: "s1"}},
+	}
+	if err := hc.commit(conn, repo); err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+	if refs := conn.values[*namespace+":refs:"+repo]; refs != string(hc.refs) {
+		t.Errorf("Refs are %q after a failed notification", refs)
+	}
+	if n := len(conn.lists[*namespace+":events:"+repo]); n != 1 {
+		t.Errorf("%d events recorded, expected 1", n)
+	}
+	if n := len(conn.lists[*namespace+":notifications"]); n != 1 {
+		t.Fatalf("%d notifications queued, expected 1", n)
+	}
+
+	fail = false
+	if err := sendNotification(conn, repo, "second", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 || len(received[0].Events) != 1 || received[1].Text != "second" {
+		t.Errorf("Received notifications %v", received)
+	}
+	if n := len(conn.lists[*namespace+":notifications"]); n != 0 {
+		t.Errorf("%d notifications still queued", n)
+	}
+	if err := flushNotifications(conn); err != nil || len(received) != 2 {
+		t.Errorf("Flushing an empty queue sent %d notifications, %v", len(received), err)
+	}
+}
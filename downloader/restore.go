@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// With -restore <repo> -restore-to <git url>, an archive of repo is read
+// back from the first destination that supports it and pushed to the
+// (existing, empty) repository at -restore-to, followed by the LFS objects
+// stored for repo on the same destination. The latest snapshot is used
+// unless another one is given with -snapshot.
+
+// untar unpacks the gzipped tarball r into dir.
+func untar(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewReader(gz)
+	root := filepath.Clean(dir) + string(os.PathSeparator)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(target, root) {
+			return fmt.Errorf("Invalid path %s in archive", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)&os.ModePerm)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, archive)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// fetchArchive unpacks the archive name from f into dir.
+func fetchArchive(f fetcher, name, dir string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(f.Fetch(name, w))
+	}()
+	err := untar(r, dir)
+	// Stop the download if unpacking failed.
+	r.CloseWithError(fmt.Errorf("Unpacking aborted"))
+	return err
+}
+
+// fetchLFSObject downloads the LFS object oid stored as name into the LFS
+// storage of the bare clone in dir, verifying its content.
+func fetchLFSObject(f fetcher, oid, name, dir string) error {
+	if len(oid) != 64 {
+		return fmt.Errorf("Invalid LFS object id %s", oid)
+	}
+	p := filepath.Join(dir, "lfs", "objects", oid[0:2], oid[2:4], oid)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if err := f.Fetch(name, io.MultiWriter(file, h)); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != oid {
+		return fmt.Errorf("LFS object %s is corrupt, its content has id %s", oid, sum)
+	}
+	return file.Close()
+}
+
+// findBareClone returns the bare clone of repo in the unpacked archive in
+// dir. Archives made before a rename contain the clone under its old name.
+func findBareClone(repo, dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, bareName(repo))); err == nil {
+		return filepath.Join(dir, bareName(repo)), nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if info.IsDir() && strings.HasSuffix(info.Name(), ".git") && !strings.HasSuffix(info.Name(), ".wiki.git") {
+			return filepath.Join(dir, info.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("No repository found in archive")
+}
+
+// restoreRepository pushes the archive snapshot of repo (the latest one if
+// empty) and its LFS objects from the first readable of dests to target.
+func restoreRepository(conn redis.Conn, repo, target, snapshot string, dests []*destination) error {
+	var dest *destination
+	var f fetcher
+	for _, d := range dests {
+		var ok bool
+		if f, ok = d.storage.(fetcher); ok {
+			dest = d
+			break
+		}
+	}
+	if dest == nil {
+		return fmt.Errorf("None of the destinations can be read from")
+	}
+	if snapshot == "" {
+		var err error
+		snapshot, err = redis.String(conn.Do("LINDEX", *namespace+":snapshots:"+repo, -1))
+		if err == redis.ErrNil {
+			return fmt.Errorf("%s has no snapshots", repo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", *namespace)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	log.Printf("Fetching %s from %s...", snapshot, dest.name)
+	if err := fetchArchive(f, snapshot, dir); err != nil {
+		return fmt.Errorf("Could not fetch %s: %s", snapshot, err)
+	}
+	bare, err := findBareClone(repo, dir)
+	if err != nil {
+		return err
+	}
+
+	pushURL, env, err := credentials.lookup(target).gitEnv(target)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pushing %s to %s...", repo, redactURL(target))
+	if err := pushMirror(bare, pushURL, env); err != nil {
+		return err
+	}
+
+	objects, err := redis.StringMap(conn.Do("HGETALL", storedKey("lfs", dest, repo)))
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+	log.Printf("Fetching %d LFS objects...", len(objects))
+	for oid, name := range objects {
+		if err := fetchLFSObject(f, oid, name, bare); err != nil {
+			return fmt.Errorf("Could not fetch LFS object %s: %s", oid, err)
+		}
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", "lfs", "push", "--all", pushURL)
+	cmd.Dir = bare
+	cmd.Env = gitEnviron(env)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not push LFS objects: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
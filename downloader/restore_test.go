@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestRestoreRepository(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	work := filepath.Join(tmp, "work")
+	os.Mkdir(work, 0755)
+	runGit(t, work, "init", "-q")
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "first")
+	head := runGit(t, work, "rev-parse", "HEAD")
+
+	clone := filepath.Join(tmp, "clone")
+	os.Mkdir(clone, 0755)
+	runGit(t, clone, "clone", "-q", "--bare", work, "old.git")
+	ls, err := newLocalStorage(&url.URL{Path: filepath.Join(tmp, "dest")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload(ls, "owner/old/1.tar.gz", clone, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(tmp, "target.git")
+	runGit(t, tmp, "init", "-q", "--bare", target)
+	dests := []*destination{{name: "file://dest", storage: ls}}
+	// The repository was renamed after the archive was made.
+	err = restoreRepository(newFakeConn(), "git@github.com:owner/new.git", target, "owner/old/1.tar.gz", dests)
+	if err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	if got := runGit(t, target, "rev-parse", "HEAD"); got != head {
+		t.Errorf("Restored HEAD is %s, expected %s", got, head)
+	}
+}
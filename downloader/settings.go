@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	gh "github.com/google/go-github/github"
+)
+
+// With -settings, the configuration of GitHub repositories is written to
+// settings.json in every archive, so it can be recreated. Most of it is only
+// visible to admins of the repository. Sections that could not be read are
+// listed with their error under "errors" instead of failing the backup.
+
+type repoSettings struct {
+	Repository       json.RawMessage            `json:"repository,omitempty"`
+	Topics           []string                   `json:"topics"`
+	BranchProtection map[string]json.RawMessage `json:"branch_protection"`
+	Collaborators    []json.RawMessage          `json:"collaborators"`
+	Teams            []json.RawMessage          `json:"teams"`
+	Hooks            []map[string]interface{}   `json:"hooks"`
+	DeployKeys       []json.RawMessage          `json:"deploy_keys"`
+	Errors           map[string]string          `json:"errors,omitempty"`
+}
+
+// getJSON decodes the response of endpoint into v. accept overrides the
+// media type, e.g. for API previews.
+func getJSON(ghAPI *gh.Client, endpoint, accept string, v interface{}) (*gh.Response, error) {
+	req, err := ghAPI.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return ghAPI.Do(req, v)
+}
+
+// listAll returns all items of a paginated list.
+func listAll(ghAPI *gh.Client, endpoint string) ([]json.RawMessage, error) {
+	all := []json.RawMessage{}
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	page := 1
+	for page != 0 {
+		items := []json.RawMessage{}
+		resp, err := getJSON(ghAPI, fmt.Sprintf("%s%sper_page=100&page=%d", endpoint, sep, page), "", &items)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		page = resp.NextPage
+	}
+	return all, nil
+}
+
+// pathEscape encodes s as a single path segment, including any slashes.
+func pathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// stripHookSecrets removes the secret and any credentials in the url from
+// the configuration of a webhook.
+func stripHookSecrets(hook map[string]interface{}) {
+	config, ok := hook["config"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	delete(config, "secret")
+	if s, ok := config["url"].(string); ok {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			u.User = nil
+			config["url"] = u.String()
+		}
+	}
+}
+
+// exportSettings writes the settings of repo to settings.json in dir.
+func exportSettings(repo, dir string, cred *credential) error {
+	owner, name, err := githubName(repo)
+	if err != nil {
+		return err
+	}
+	token := ""
+	if cred != nil {
+		token = cred.token
+	}
+	ghAPI, err := newGithubClient(token)
+	if err != nil {
+		return err
+	}
+	base := "repos/" + owner + "/" + name
+
+	s := &repoSettings{
+		BranchProtection: map[string]json.RawMessage{},
+		Errors:           map[string]string{},
+	}
+	fail := func(section string, err error) {
+		s.Errors[section] = err.Error()
+	}
+	if _, err := getJSON(ghAPI, base, "", &s.Repository); err != nil {
+		// Without the repository, nothing else will work either.
+		return err
+	}
+
+	topics := struct {
+		Names []string `json:"names"`
+	}{}
+	if _, err := getJSON(ghAPI, base+"/topics", "application/vnd.github.mercy-preview+json", &topics); err != nil {
+		fail("topics", err)
+	}
+	s.Topics = topics.Names
+
+	if branches, err := listAll(ghAPI, base+"/branches?protected=true"); err != nil {
+		fail("branch_protection", err)
+	} else {
+		for _, b := range branches {
+			branch := struct {
+				Name string `json:"name"`
+			}{}
+			if err := json.Unmarshal(b, &branch); err != nil {
+				fail("branch_protection", err)
+				continue
+			}
+			protection := json.RawMessage{}
+			if _, err := getJSON(ghAPI, base+"/branches/"+pathEscape(branch.Name)+"/protection", "", &protection); err != nil {
+				fail("branch_protection:"+branch.Name, err)
+				continue
+			}
+			s.BranchProtection[branch.Name] = protection
+		}
+	}
+
+	if s.Collaborators, err = listAll(ghAPI, base+"/collaborators?affiliation=direct"); err != nil {
+		fail("collaborators", err)
+	}
+	if s.Teams, err = listAll(ghAPI, base+"/teams"); err != nil {
+		fail("teams", err)
+	}
+	if s.DeployKeys, err = listAll(ghAPI, base+"/keys"); err != nil {
+		fail("deploy_keys", err)
+	}
+	if hooks, err := listAll(ghAPI, base+"/hooks"); err != nil {
+		fail("hooks", err)
+	} else {
+		for _, h := range hooks {
+			hook := map[string]interface{}{}
+			if err := json.Unmarshal(h, &hook); err != nil {
+				fail("hooks", err)
+				continue
+			}
+			stripHookSecrets(hook)
+			s.Hooks = append(s.Hooks, hook)
+		}
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "settings.json"), data, 0644)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sftpStorage stores archives via SFTP using the system's sftp client and
+// the SSH key the repositories are cloned with (or the one given with the
+// key parameter). The server's host key has to
+// be pinned either with the hostkey parameter (e.g.
+// ?hostkey=ssh-ed25519%20AAAA...) or a known_hosts file (?known_hosts=<file>).
+//
+// As sftp can only upload regular files, archives are spooled to a temporary
+// file first.
+type sftpStorage struct {
+	url        *url.URL
+	knownHosts string
+	key        string
+	// ownKnownHosts is set if knownHosts is a temporary file created from
+	// the hostkey parameter.
+	ownKnownHosts bool
+}
+
+func newSftpStorage(u *url.URL) (*sftpStorage, error) {
+	q := u.Query()
+	ss := &sftpStorage{
+		url:        u,
+		knownHosts: q.Get("known_hosts"),
+		key:        q.Get("key"),
+	}
+	if ss.key == "" {
+		ss.key = sshKeyFile
+	}
+
+	if hostKey := q.Get("hostkey"); hostKey != "" {
+		host := u.Host
+		if h, port, err := net.SplitHostPort(u.Host); err == nil {
+			host = h
+			if port != "22" {
+				host = "[" + h + "]:" + port
+			}
+		}
+		f, err := ioutil.TempFile("", "known_hosts")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := fmt.Fprintf(f, "%s %s\n", host, hostKey); err != nil {
+			os.Remove(f.Name())
+			return nil, err
+		}
+		ss.knownHosts = f.Name()
+		ss.ownKnownHosts = true
+	}
+	if ss.knownHosts == "" {
+		return nil, fmt.Errorf("SFTP destinations require the hostkey or known_hosts parameter")
+	}
+
+	// Check connectivity and the host key right away.
+	if _, err := ss.batch("pwd"); err != nil {
+		ss.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// batch runs the given sftp commands in batch mode and returns the output.
+// Commands prefixed with "-" may fail without aborting the batch.
+func (ss *sftpStorage) batch(cmds ...string) (string, error) {
+	args := []string{
+		"-b", "-",
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + ss.knownHosts,
+	}
+	if ss.key != "" {
+		args = append(args, "-o", "IdentitiesOnly=yes", "-i", ss.key)
+	}
+	host := ss.url.Host
+	if h, port, err := net.SplitHostPort(ss.url.Host); err == nil {
+		host = h
+		args = append(args, "-P", port)
+	}
+	if ss.url.User != nil {
+		host = ss.url.User.Username() + "@" + host
+	}
+	args = append(args, host)
+
+	// Paths are absolute unless they start with /~/, in which case they are
+	// relative to the home directory.
+	script := &bytes.Buffer{}
+	if dir := strings.TrimPrefix(ss.url.Path, "/~/"); dir != "" {
+		fmt.Fprintf(script, "cd %s\n", quoteSftp(dir))
+	}
+	for _, c := range cmds {
+		fmt.Fprintln(script, c)
+	}
+
+	out := &bytes.Buffer{}
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = script
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return out.String(), fmt.Errorf("sftp failed: %s: %s", err, strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
+
+// quoteSftp quotes an argument for an sftp batch file.
+func quoteSftp(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func (ss *sftpStorage) Store(name string, r io.Reader) error {
+	f, err := ioutil.TempFile("", "github-backup-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	tmp := tempName(name)
+	cmds := []string{}
+	cur := ""
+	for _, s := range strings.Split(path.Dir(name), "/") {
+		cur = path.Join(cur, s)
+		cmds = append(cmds, "-mkdir "+quoteSftp(cur))
+	}
+	cmds = append(cmds,
+		"put "+quoteSftp(f.Name())+" "+quoteSftp(tmp),
+		"ls -ln "+quoteSftp(tmp),
+	)
+	out, err := ss.batch(cmds...)
+	if err != nil {
+		ss.batch("-rm " + quoteSftp(tmp))
+		return err
+	}
+	size, err := parseSftpSize(out)
+	if err != nil {
+		ss.batch("-rm " + quoteSftp(tmp))
+		return fmt.Errorf("Could not verify upload: %s", err)
+	}
+	if size != n {
+		ss.batch("-rm " + quoteSftp(tmp))
+		return fmt.Errorf("Upload incomplete: sent %d bytes, server has %d", n, size)
+	}
+	if _, err := ss.batch("rename " + quoteSftp(tmp) + " " + quoteSftp(name)); err != nil {
+		ss.batch("-rm " + quoteSftp(tmp))
+		return err
+	}
+	return nil
+}
+
+// parseSftpSize extracts the file size from the output of "ls -ln".
+func parseSftpSize(out string) (int64, error) {
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "-") {
+			continue
+		}
+		return strconv.ParseInt(fields[4], 10, 64)
+	}
+	return 0, fmt.Errorf("No file listing in sftp output")
+}
+
+func (ss *sftpStorage) List(dir string) ([]string, error) {
+	out, err := ss.batch("ls -1 " + quoteSftp(dir))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		// Skip the commands echoed in batch mode.
+		if strings.HasPrefix(line, "sftp>") {
+			continue
+		}
+		if name := path.Base(line); isArchive(name) {
+			names = append(names, path.Join(dir, name))
+		}
+	}
+	return names, nil
+}
+
+// Fetch downloads name to a temporary file first, like Store.
+func (ss *sftpStorage) Fetch(name string, w io.Writer) error {
+	f, err := ioutil.TempFile("", "github-backup-download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := ss.batch("get " + quoteSftp(name) + " " + quoteSftp(f.Name())); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (ss *sftpStorage) Remove(name string) error {
+	_, err := ss.batch("rm " + quoteSftp(name))
+	return err
+}
+
+func (ss *sftpStorage) Close() error {
+	if ss.ownKnownHosts {
+		return os.Remove(ss.knownHosts)
+	}
+	return nil
+}
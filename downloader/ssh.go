@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// sshKeyEnv is the environment variable the SSH key can be passed in,
+// either PEM encoded or base64 encoded.
+const sshKeyEnv = "GITHUB_BACKUP_SSH_KEY"
+
+// githubKnownHosts are GitHub's published SSH host keys, see
+// https://docs.github.com/en/authentication/keeping-your-account-and-data-secure/githubs-ssh-key-fingerprints
+// Gists are served with the same keys.
+const githubKnownHosts = `github.com,gist.github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+github.com,gist.github.com ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=
+`
+
+var (
+	// sshKeyFile and sshKnownHostsFile are the files set up by setupSSH.
+	// sshKeyFile is empty if no key has been given.
+	sshKeyFile        string
+	sshKnownHostsFile string
+
+	// sshTempFiles are removed by cleanupSSH.
+	sshTempFiles []string
+	sshTempMu    sync.Mutex
+)
+
+// writeTempFile writes content to a new temporary file only readable by the
+// current user.
+func writeTempFile(prefix string, content []byte) (string, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", fmt.Errorf("Error creating temporary file: %s", err)
+	}
+	defer f.Close()
+	sshTempMu.Lock()
+	sshTempFiles = append(sshTempFiles, f.Name())
+	sshTempMu.Unlock()
+	if err := f.Chmod(os.FileMode(0600)); err != nil {
+		return "", fmt.Errorf("Error securing file %s: %s", f.Name(), err)
+	}
+	if _, err := f.Write(content); err != nil {
+		return "", fmt.Errorf("Error writing file %s: %s", f.Name(), err)
+	}
+	return f.Name(), nil
+}
+
+// decodeKey accepts a PEM encoded key as is and decodes everything else as
+// base64.
+func decodeKey(s string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN") {
+		return []byte(s), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding key: %s", err)
+	}
+	return key, nil
+}
+
+// setupSSH prepares the SSH key and known hosts used by git and sftp. The
+// key is taken from keyFile, the environment variable sshKeyEnv or the
+// deprecated base64 encoded encKey, in that order. Host keys are always
+// verified, either against the given known_hosts file or against GitHub's
+// published keys.
+//
+// Nothing is written to the user's ~/.ssh. git picks the settings up
+// through GIT_SSH_COMMAND, so any existing SSH configuration still applies.
+// sshKeyEnv is removed from the environment.
+func setupSSH(keyFile, encKey, knownHosts string) error {
+	s := os.Getenv(sshKeyEnv)
+	// git, ssh and everything else started later must not inherit the key.
+	os.Unsetenv(sshKeyEnv)
+	switch {
+	case keyFile != "":
+		sshKeyFile = keyFile
+	case s != "" || encKey != "":
+		if s == "" {
+			s = encKey
+		}
+		key, err := decodeKey(s)
+		if err != nil {
+			return err
+		}
+		if sshKeyFile, err = writeTempFile("github-backup-key", key); err != nil {
+			return err
+		}
+	}
+
+	sshKnownHostsFile = knownHosts
+	if sshKnownHostsFile == "" {
+		var err error
+		sshKnownHostsFile, err = writeTempFile("github-backup-known_hosts", []byte(githubKnownHosts))
+		if err != nil {
+			return err
+		}
+	}
+	return os.Setenv("GIT_SSH_COMMAND", strings.Join(sshCommand(sshKeyFile), " "))
+}
+
+// sshCommand returns the ssh invocation using the given key (if any) and
+// the pinned host keys, with all arguments shell quoted.
+func sshCommand(key string) []string {
+	cmd := []string{
+		"ssh",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", shellQuote("UserKnownHostsFile=" + sshKnownHostsFile),
+	}
+	if key != "" {
+		cmd = append(cmd, "-o", "IdentitiesOnly=yes", "-i", shellQuote(key))
+	}
+	return cmd
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// cleanupSSH removes the temporary files created by setupSSH.
+func cleanupSSH() {
+	sshTempMu.Lock()
+	defer sshTempMu.Unlock()
+	for _, f := range sshTempFiles {
+		os.Remove(f)
+	}
+	sshTempFiles = nil
+}
+
+// cleanupSSHOnSignal makes the process call cleanupSSH and exit when it is
+// interrupted, terminated or hung up on.
+func cleanupSSHOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		fatalf("Received %s, exiting", <-c)
+	}()
+}
+
+// fatalf is log.Fatalf for everything running after setupSSH. log.Fatalf
+// skips deferred calls, so it calls cleanupSSH itself.
+func fatalf(format string, v ...interface{}) {
+	cleanupSSH()
+	log.Fatalf(format, v...)
+}
+
+// cloneError is a failed clone together with the class of its cause, which
+// is recorded in the repository's status.
+type cloneError struct {
+	class string
+	err   error
+}
+
+func (ce *cloneError) Error() string {
+	return ce.err.Error()
+}
+
+const (
+	// errClassHostKey means the server's host key did not match the
+	// pinned one.
+	errClassHostKey = "hostkey"
+	// errClassNotFound means the repository does not exist (any more) or
+	// is not accessible.
+	errClassNotFound = "notfound"
+)
+
+// classifyCloneError turns the failure of git clone into a cloneError if
+// its output points to a known cause.
+func classifyCloneError(err error, stderr string) error {
+	switch {
+	case strings.Contains(stderr, "Host key verification failed"),
+		strings.Contains(stderr, "REMOTE HOST IDENTIFICATION HAS CHANGED"):
+		return &cloneError{
+			class: errClassHostKey,
+			err:   fmt.Errorf("Host key verification failed: %s", err),
+		}
+	case strings.Contains(stderr, "Repository not found"),
+		strings.Contains(stderr, "does not appear to be a git repository"):
+		return &cloneError{
+			class: errClassNotFound,
+			err:   fmt.Errorf("Repository not found: %s", err),
+		}
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// status is the outcome of one step of backing up a repository. Statuses
+// are kept in the hash <namespace>:status:<repo>, keyed by step.
+type status struct {
+	Time  time.Time `json:"time"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+	// Class categorizes errors that need special attention, e.g. host key
+	// mismatches.
+	Class string `json:"class,omitempty"`
+}
+
+// recordStatus saves the outcome of step for repo. A nil err means success.
+func recordStatus(conn redis.Conn, repo, step string, err error) {
+	s := status{
+		Time: time.Now(),
+		OK:   err == nil,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if ce, ok := err.(*cloneError); ok {
+		s.Class = ce.class
+	}
+	data, jerr := json.Marshal(s)
+	if jerr != nil {
+		log.Printf("Error encoding status: %s", jerr)
+		return
+	}
+	if _, err := conn.Do("HSET", *namespace+":status:"+repo, step, data); err != nil {
+		log.Printf("Error saving status: %s", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// storage is a destination archives are uploaded to.
+type storage interface {
+	// Store uploads the content of r to name. A failed upload must never
+	// leave a (partial) file under name. Intermediate directories are
+	// created as needed.
+	Store(name string, r io.Reader) error
+	Close() error
+}
+
+// pruner is implemented by storages that can delete old archives.
+type pruner interface {
+	// List returns the names of all archives in dir.
+	List(dir string) ([]string, error)
+	Remove(name string) error
+}
+
+// fetcher is implemented by storages files can be read back from, which
+// -restore needs.
+type fetcher interface {
+	// Fetch writes the content of name to w.
+	Fetch(name string, w io.Writer) error
+}
+
+// openStorage connects to the destination described by s.
+func openStorage(s string) (storage, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination url: %s", err)
+	}
+	switch u.Scheme {
+	case "ftp", "ftps":
+		return newFtpStorage(u)
+	case "sftp":
+		return newSftpStorage(u)
+	case "webdav", "webdavs", "dav", "davs":
+		return newWebdavStorage(u)
+	case "file":
+		return newLocalStorage(u)
+	}
+	return nil, fmt.Errorf("Unsupported destination scheme %s", u.Scheme)
+}
+
+// tempName returns the name an upload to name is written to before it is
+// moved into place. It is hidden and does not carry the archive extension so
+// it cannot be mistaken for a finished backup.
+func tempName(name string) string {
+	return path.Join(path.Dir(name), "."+path.Base(name)+".part")
+}
+
+// isArchive reports whether the file name (without directory) is a finished
+// archive.
+func isArchive(name string) bool {
+	return strings.HasSuffix(name, archiveExt) && !strings.HasPrefix(name, ".")
+}
+
+// prune deletes all but the newest keep archives in dir. Storages that
+// cannot list their content are left untouched.
+func prune(dest storage, dir string, keep int, protected map[string]bool) error {
+	p, ok := dest.(pruner)
+	if !ok || keep <= 0 {
+		return nil
+	}
+	all, err := p.List(dir)
+	if err != nil {
+		return err
+	}
+	// Protected archives are neither removed nor counted.
+	names := []string{}
+	for _, name := range all {
+		if !protected[name] {
+			names = append(names, name)
+		}
+	}
+	// Archive names are timestamps, so they sort chronologically.
+	sort.Strings(names)
+	for len(names) > keep {
+		log.Printf("Pruning %s...", names[0])
+		if err := p.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	N int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.N += int64(n)
+	return n, err
+}
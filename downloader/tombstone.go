@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Repositories that could not be found upstream on -tombstone-after runs in
+// a row are considered deleted, if that can be confirmed: GitHub answers
+// "not found" as well when access was lost, e.g. through a removed deploy
+// key. Deleted repositories get a tombstone in the hash
+// <namespace>:tombstones and are not cloned any more. Their snapshots are
+// added to the set <namespace>:protected, which pruning skips, so the last
+// copies are kept even if a repository of the same name shows up again.
+// Releasing the tombstone with -release lifts both.
+
+type tombstone struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+func isTombstoned(conn redis.Conn, repo string) (bool, error) {
+	return redis.Bool(conn.Do("HEXISTS", *namespace+":tombstones", repo))
+}
+
+// noteCloneResult counts consecutive "not found" errors of repo, which was
+// cloned with cred, and buries it once there were enough of them and its
+// deletion is confirmed. If it is not, the repository is kept and the loss
+// of access is reported instead. A successful clone resets the count, other
+// errors leave it alone.
+func noteCloneResult(conn redis.Conn, repo string, cred *credential, err error) error {
+	if err == nil {
+		_, err := conn.Do("HDEL", *namespace+":not_found", repo)
+		return err
+	}
+	if ce, ok := err.(*cloneError); !ok || ce.class != errClassNotFound {
+		return nil
+	}
+	n, rerr := redis.Int(conn.Do("HINCRBY", *namespace+":not_found", repo, 1))
+	if rerr != nil {
+		return rerr
+	}
+	if n < *tombAfter {
+		log.Printf("%s not found upstream (%d/%d)", repo, n, *tombAfter)
+		return nil
+	}
+	deleted, rerr := confirmDeleted(conn, repo, cred)
+	if rerr != nil {
+		log.Printf("Error confirming deletion of %s: %s", repo, rerr)
+	}
+	if !deleted {
+		log.Printf("%s not found upstream for %d runs, but its deletion could not be confirmed, so it is kept", repo, n)
+		if n == *tombAfter {
+			text := fmt.Sprintf("%s could not be cloned on %d runs in a row (%s). It may have been deleted, or access to it was lost.", repo, n, err)
+			if err := sendNotification(conn, repo, text, nil); err != nil {
+				log.Printf("Error sending notification: %s", err)
+			}
+		}
+		return nil
+	}
+
+	log.Printf("%s was deleted upstream, keeping its snapshots", repo)
+	snapshots, rerr := redis.Strings(conn.Do("LRANGE", *namespace+":snapshots:"+repo, 0, -1))
+	if rerr != nil {
+		return rerr
+	}
+	if len(snapshots) > 0 {
+		if _, err := conn.Do("SADD", redis.Args{}.Add(*namespace+":protected").AddFlat(snapshots)...); err != nil {
+			return err
+		}
+	}
+	data, rerr := json.Marshal(tombstone{time.Now(), err.Error()})
+	if rerr != nil {
+		return rerr
+	}
+	if _, err := conn.Do("HSET", *namespace+":tombstones", repo, data); err != nil {
+		return err
+	}
+	if _, err := conn.Do("HDEL", *namespace+":not_found", repo); err != nil {
+		return err
+	}
+	text := fmt.Sprintf("%s was deleted upstream, its snapshots are kept. Release them with -release %s.", repo, repo)
+	if err := sendNotification(conn, repo, text, nil); err != nil {
+		log.Printf("Error sending notification: %s", err)
+	}
+	return nil
+}
+
+// confirmDeleted reports whether repo was deleted rather than made
+// inaccessible. That is the case if the frontend marked it gone, or if the
+// API does not find it while accepting the token of cred. Without a token,
+// only the frontend can confirm it.
+func confirmDeleted(conn redis.Conn, repo string, cred *credential) (bool, error) {
+	gone, err := redis.Bool(conn.Do("HEXISTS", *namespace+":gone_repos", repo))
+	if err != nil || gone {
+		return gone, err
+	}
+	if !onGithub(repo) || cred == nil || cred.token == "" {
+		return false, nil
+	}
+	ghAPI, err := newGithubClient(cred.token)
+	if err != nil {
+		return false, err
+	}
+	endpoint, err := githubEndpoint(conn, repo)
+	if err != nil {
+		return false, err
+	}
+	resp, err := getJSON(ghAPI, endpoint, "", nil)
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return false, err
+	}
+	// A token that stopped working gets 404 as well.
+	if _, err := getJSON(ghAPI, "user", "", nil); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// githubEndpoint returns the API endpoint of repo. Repositories are looked
+// up by the id the frontend recorded if there is one, so a rename is not
+// mistaken for a deletion.
+func githubEndpoint(conn redis.Conn, repo string) (string, error) {
+	if strings.HasPrefix(repo, "git@gist.github.com:") {
+		return "gists/" + strings.TrimSuffix(strings.TrimPrefix(repo, "git@gist.github.com:"), ".git"), nil
+	}
+	id, err := redis.String(conn.Do("HGET", *namespace+":repo_ids", repo))
+	if err == nil {
+		return "repositories/" + id, nil
+	}
+	if err != redis.ErrNil {
+		return "", err
+	}
+	owner, name, err := githubName(repo)
+	if err != nil {
+		return "", err
+	}
+	return "repos/" + owner + "/" + name, nil
+}
+
+// releaseTombstone lets repo be cloned again and its snapshots be pruned.
+func releaseTombstone(conn redis.Conn, repo string) error {
+	ok, err := isTombstoned(conn, repo)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s has no tombstone", repo)
+	}
+	snapshots, err := redis.Strings(conn.Do("LRANGE", *namespace+":snapshots:"+repo, 0, -1))
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		if _, err := conn.Do("SREM", redis.Args{}.Add(*namespace+":protected").AddFlat(snapshots)...); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("HDEL", *namespace+":tombstones", repo)
+	return err
+}
+
+// protectedSnapshots returns the set of archives pruning has to keep. Besides
+// those in <namespace>:protected, these are the bases of metadata exports.
+func protectedSnapshots(conn redis.Conn) (map[string]bool, error) {
+	names, err := redis.Strings(conn.Do("SUNION", *namespace+":protected", *namespace+":protected_metadata"))
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]bool{}
+	for _, name := range names {
+		protected[name] = true
+	}
+	return protected, nil
+}
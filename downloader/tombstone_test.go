@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const tombstoneRepo = "git@github.com:owner/repo.git"
+
+func notFound() error {
+	return &cloneError{class: errClassNotFound, err: fmt.Errorf("Repository not found")}
+}
+
+// cloneRuns records the given clone results of tombstoneRepo.
+func cloneRuns(t *testing.T, conn *fakeConn, cred *credential, results ...error) {
+	for _, err := range results {
+		if err := noteCloneResult(conn, tombstoneRepo, cred, err); err != nil {
+			t.Fatalf("noteCloneResult failed: %s", err)
+		}
+	}
+}
+
+func buried(conn *fakeConn) bool {
+	_, ok := conn.hashes[*namespace+":tombstones"][tombstoneRepo]
+	return ok
+}
+
+func TestNoteCloneResultResets(t *testing.T) {
+	conn := newFakeConn()
+	conn.hashes[*namespace+":gone_repos"] = map[string]string{tombstoneRepo: "x"}
+	cloneRuns(t, conn, nil, notFound(), notFound(), nil, notFound(), fmt.Errorf("Timeout"), notFound())
+	if buried(conn) {
+		t.Fatalf("Repository was buried although the count was reset")
+	}
+	if n := conn.hashes[*namespace+":not_found"][tombstoneRepo]; n != "2" {
+		t.Errorf("Count is %s, expected 2", n)
+	}
+	cloneRuns(t, conn, nil, nil)
+	if _, ok := conn.hashes[*namespace+":not_found"][tombstoneRepo]; ok {
+		t.Errorf("Count was not reset by a successful clone")
+	}
+}
+
+func TestNoteCloneResultThreshold(t *testing.T) {
+	tests := []struct {
+		name string
+		// gone marks the repository as gone by the frontend, repoStatus
+		// and userStatus are the answers of the API if a token is used.
+		gone                   bool
+		repoStatus, userStatus int
+		deleted                bool
+	}{
+		{"gone", true, 0, 0, true},
+		{"no confirmation", false, 0, 0, false},
+		{"api not found", false, http.StatusNotFound, http.StatusOK, true},
+		{"api found", false, http.StatusOK, http.StatusOK, false},
+		{"token revoked", false, http.StatusNotFound, http.StatusUnauthorized, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newFakeConn()
+			conn.lists[*namespace+":snapshots:"+tombstoneRepo] = []string{"a", "b"}
+			conn.hashes[*namespace+":repo_ids"] = map[string]string{tombstoneRepo: "42"}
+			if test.gone {
+				conn.hashes[*namespace+":gone_repos"] = map[string]string{tombstoneRepo: "x"}
+			}
+			var cred *credential
+			if test.repoStatus != 0 {
+				api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/repositories/42":
+						w.WriteHeader(test.repoStatus)
+					case "/user":
+						w.WriteHeader(test.userStatus)
+					default:
+						t.Errorf("Unexpected request for %s", r.URL.Path)
+						w.WriteHeader(http.StatusNotFound)
+					}
+					fmt.Fprint(w, "{}")
+				}))
+				defer api.Close()
+				old := *githubAPI
+				*githubAPI = api.URL + "/"
+				defer func() { *githubAPI = old }()
+				cred = &credential{token: "token"}
+			}
+
+			for i := 1; i < *tombAfter; i++ {
+				cloneRuns(t, conn, cred, notFound())
+			}
+			if buried(conn) {
+				t.Fatalf("Repository was buried before -tombstone-after runs")
+			}
+			cloneRuns(t, conn, cred, notFound())
+			if buried(conn) != test.deleted {
+				t.Fatalf("Repository buried: %v, expected %v", buried(conn), test.deleted)
+			}
+			protected := conn.sets[*namespace+":protected"]
+			if test.deleted {
+				if !protected["a"] || !protected["b"] {
+					t.Errorf("Snapshots are not protected: %v", protected)
+				}
+				if _, ok := conn.hashes[*namespace+":not_found"][tombstoneRepo]; ok {
+					t.Errorf("Count was not cleared")
+				}
+			} else if len(protected) != 0 {
+				t.Errorf("Snapshots of a kept repository are protected: %v", protected)
+			}
+		})
+	}
+}
+
+func TestReleaseTombstone(t *testing.T) {
+	conn := newFakeConn()
+	if err := releaseTombstone(conn, tombstoneRepo); err == nil {
+		t.Errorf("Released a repository without tombstone")
+	}
+	conn.lists[*namespace+":snapshots:"+tombstoneRepo] = []string{"a", "b"}
+	conn.hashes[*namespace+":gone_repos"] = map[string]string{tombstoneRepo: "x"}
+	conn.sets[*namespace+":protected"] = map[string]bool{"c": true}
+	for i := 0; i < *tombAfter; i++ {
+		cloneRuns(t, conn, nil, notFound())
+	}
+	if !buried(conn) {
+		t.Fatalf("Repository was not buried")
+	}
+	if err := releaseTombstone(conn, tombstoneRepo); err != nil {
+		t.Fatalf("Release failed: %s", err)
+	}
+	if buried(conn) {
+		t.Errorf("Tombstone is still there")
+	}
+	protected := conn.sets[*namespace+":protected"]
+	if protected["a"] || protected["b"] || !protected["c"] {
+		t.Errorf("Expected only c to stay protected, got %v", protected)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// webdavStorage stores archives on a WebDAV server (e.g. Nextcloud).
+// webdav:// and dav:// use plain HTTP, davs:// and webdavs:// use HTTPS.
+// Credentials are taken from the url and sent using basic auth.
+//
+// Archives are streamed with a chunked PUT to a temporary name, verified
+// with PROPFIND and moved into place with MOVE.
+type webdavStorage struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func newWebdavStorage(u *url.URL) (*webdavStorage, error) {
+	base := *u
+	switch u.Scheme {
+	case "webdav", "dav":
+		base.Scheme = "http"
+	case "webdavs", "davs":
+		base.Scheme = "https"
+	}
+	ws := &webdavStorage{
+		base:   &base,
+		client: &http.Client{},
+	}
+	if _, err := ws.propfind("", "0"); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// url returns the absolute url of name. Collections get a trailing slash.
+func (ws *webdavStorage) url(name string, collection bool) string {
+	u := *ws.base
+	u.User = nil
+	u.RawQuery = ""
+	u.Path = path.Join("/", ws.base.Path, name)
+	if collection {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (ws *webdavStorage) do(method, name string, collection bool, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, ws.url(name, collection), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if ws.base.User != nil {
+		pass, _ := ws.base.User.Password()
+		req.SetBasicAuth(ws.base.User.Username(), pass)
+	}
+	return ws.client.Do(req)
+}
+
+// expect closes the body of resp and returns an error if its status code is
+// not one of codes.
+func expect(resp *http.Response, codes ...int) error {
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	for _, c := range codes {
+		if resp.StatusCode == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+// mkcolAll creates dir and all its parents. 405 means the collection exists
+// already.
+func (ws *webdavStorage) mkcolAll(dir string) error {
+	cur := ""
+	for _, s := range strings.Split(dir, "/") {
+		cur = path.Join(cur, s)
+		resp, err := ws.do("MKCOL", cur, true, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expect(resp, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string `xml:"DAV: href"`
+	Propstat []struct {
+		Prop struct {
+			ContentLength string `xml:"DAV: getcontentlength"`
+			ResourceType  struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+		} `xml:"DAV: prop"`
+	} `xml:"DAV: propstat"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><getcontentlength/><resourcetype/></prop></propfind>`
+
+// propfind retrieves the size and type of name and, with depth 1, its
+// members.
+func (ws *webdavStorage) propfind(name, depth string) ([]davResponse, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := ws.do("PROPFIND", name, depth != "0", strings.NewReader(propfindBody), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 207 {
+		return nil, fmt.Errorf("PROPFIND %s: %s", resp.Request.URL.Path, resp.Status)
+	}
+	ms := &davMultistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(ms); err != nil {
+		return nil, fmt.Errorf("Invalid PROPFIND response: %s", err)
+	}
+	return ms.Responses, nil
+}
+
+func (ws *webdavStorage) size(name string) (int64, error) {
+	rs, err := ws.propfind(name, "0")
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range rs {
+		for _, ps := range r.Propstat {
+			if ps.Prop.ContentLength != "" {
+				return strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+		}
+	}
+	return 0, fmt.Errorf("Server did not report the size of %s", name)
+}
+
+func (ws *webdavStorage) Store(name string, r io.Reader) error {
+	if err := ws.mkcolAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	tmp := tempName(name)
+	cr := &countingReader{Reader: r}
+	// Hide the length of the body, so it is streamed with chunked encoding.
+	resp, err := ws.do("PUT", tmp, false, ioutil.NopCloser(cr), nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, http.StatusCreated, http.StatusNoContent, http.StatusOK); err != nil {
+		ws.Remove(tmp)
+		return err
+	}
+
+	size, err := ws.size(tmp)
+	if err != nil {
+		ws.Remove(tmp)
+		return fmt.Errorf("Could not verify upload: %s", err)
+	}
+	if size != cr.N {
+		ws.Remove(tmp)
+		return fmt.Errorf("Upload incomplete: sent %d bytes, server has %d", cr.N, size)
+	}
+
+	header := http.Header{}
+	header.Set("Destination", ws.url(name, false))
+	header.Set("Overwrite", "F")
+	resp, err = ws.do("MOVE", tmp, false, nil, header)
+	if err == nil {
+		err = expect(resp, http.StatusCreated, http.StatusNoContent)
+	}
+	if err != nil {
+		ws.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (ws *webdavStorage) List(dir string) ([]string, error) {
+	rs, err := ws.propfind(dir, "1")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, r := range rs {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid href %s in PROPFIND response", r.Href)
+		}
+		name := path.Base(href.Path)
+		if isArchive(name) {
+			names = append(names, path.Join(dir, name))
+		}
+	}
+	return names, nil
+}
+
+func (ws *webdavStorage) Fetch(name string, w io.Writer) error {
+	resp, err := ws.do("GET", name, false, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", resp.Request.URL.Path, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (ws *webdavStorage) Remove(name string) error {
+	resp, err := ws.do("DELETE", name, false, nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+}
+
+func (ws *webdavStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDav is a WebDAV server below /dav keeping files in memory.
+type fakeDav struct {
+	// sizeDelta is added to the sizes PROPFIND reports.
+	sizeDelta int
+	// hrefs overrides the hrefs of the members listed by PROPFIND.
+	hrefs []string
+
+	mu        sync.Mutex
+	files     map[string]string
+	dirs      map[string]bool
+	moves     int
+	overwrite []string
+}
+
+func newFakeDav() *fakeDav {
+	return &fakeDav{files: map[string]string{}, dirs: map[string]bool{"/dav": true}}
+}
+
+func davEntry(href string, size int, collection bool) string {
+	prop := fmt.Sprintf("<d:getcontentlength>%d</d:getcontentlength><d:resourcetype/>", size)
+	if collection {
+		prop = "<d:resourcetype><d:collection/></d:resourcetype>"
+	}
+	return "<d:response><d:href>" + href + "</d:href><d:propstat><d:prop>" + prop +
+		"</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>"
+}
+
+func (fd *fakeDav) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	name := strings.TrimSuffix(r.URL.Path, "/")
+	switch r.Method {
+	case "PROPFIND":
+		entries := []string{}
+		switch content, ok := fd.files[name]; {
+		case ok:
+			entries = append(entries, davEntry(r.URL.Path, len(content)+fd.sizeDelta, false))
+		case fd.dirs[name]:
+			entries = append(entries, davEntry(r.URL.Path, 0, true))
+			if r.Header.Get("Depth") != "1" {
+				break
+			}
+			if fd.hrefs != nil {
+				for _, href := range fd.hrefs {
+					entries = append(entries, davEntry(href, 1, false))
+				}
+				break
+			}
+			for f, content := range fd.files {
+				if path.Dir(f) == name {
+					entries = append(entries, davEntry(f, len(content), false))
+				}
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(207)
+		fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">%s</d:multistatus>`, strings.Join(entries, ""))
+	case "MKCOL":
+		if fd.dirs[name] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		fd.dirs[name] = true
+		w.WriteHeader(http.StatusCreated)
+	case "PUT":
+		content, _ := ioutil.ReadAll(r.Body)
+		fd.files[name] = string(content)
+		w.WriteHeader(http.StatusCreated)
+	case "GET":
+		content, ok := fd.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	case "MOVE":
+		fd.moves++
+		fd.overwrite = append(fd.overwrite, r.Header.Get("Overwrite"))
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || dest.Host != r.Host {
+			http.Error(w, "Invalid destination", http.StatusBadGateway)
+			return
+		}
+		if _, exists := fd.files[dest.Path]; exists && r.Header.Get("Overwrite") == "F" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		fd.files[dest.Path] = fd.files[name]
+		delete(fd.files, name)
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		if _, ok := fd.files[name]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(fd.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (fd *fakeDav) names() []string {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	names := []string{}
+	for name := range fd.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestDav(t *testing.T, fd *fakeDav) (*webdavStorage, func()) {
+	server := httptest.NewServer(fd)
+	u, _ := url.Parse(server.URL)
+	u.Scheme = "webdav"
+	u.Path = "/dav"
+	ws, err := newWebdavStorage(u)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Could not connect: %s", err)
+	}
+	return ws, server.Close
+}
+
+func TestWebdavStore(t *testing.T) {
+	fd := newFakeDav()
+	ws, done := newTestDav(t, fd)
+	defer done()
+
+	name := "a/b/1" + archiveExt
+	if err := ws.Store(name, bytes.NewBufferString("archive")); err != nil {
+		t.Fatalf("Store failed: %s", err)
+	}
+	if names := fd.names(); !reflect.DeepEqual(names, []string{"/dav/" + name}) {
+		t.Errorf("Files on the server: %v", names)
+	}
+	buf := &bytes.Buffer{}
+	if err := ws.Fetch(name, buf); err != nil || buf.String() != "archive" {
+		t.Errorf("Fetch = %q, %v", buf.String(), err)
+	}
+
+	// An existing archive is never overwritten.
+	if err := ws.Store(name, bytes.NewBufferString("other")); err == nil {
+		t.Errorf("Store replaced an existing archive")
+	}
+	if names := fd.names(); !reflect.DeepEqual(names, []string{"/dav/" + name}) {
+		t.Errorf("Files on the server after a refused MOVE: %v", names)
+	}
+	if fd.files["/dav/"+name] != "archive" {
+		t.Errorf("Existing archive was changed to %q", fd.files["/dav/"+name])
+	}
+	if !reflect.DeepEqual(fd.overwrite, []string{"F", "F"}) {
+		t.Errorf("MOVE sent Overwrite headers %v, expected F", fd.overwrite)
+	}
+}
+
+func TestWebdavSizeMismatch(t *testing.T) {
+	fd := newFakeDav()
+	fd.sizeDelta = -1
+	ws, done := newTestDav(t, fd)
+	defer done()
+
+	if err := ws.Store("a/1"+archiveExt, bytes.NewBufferString("archive")); err == nil {
+		t.Errorf("Store succeeded although the server has fewer bytes")
+	}
+	if names := fd.names(); len(names) != 0 {
+		t.Errorf("Files left on the server: %v", names)
+	}
+	if fd.moves != 0 {
+		t.Errorf("Incomplete upload moved into place")
+	}
+}
+
+func TestWebdavList(t *testing.T) {
+	fd := newFakeDav()
+	ws, done := newTestDav(t, fd)
+	defer done()
+	fd.dirs["/dav/a"] = true
+	fd.hrefs = []string{
+		"/dav/a/1" + archiveExt,
+		// Some servers send absolute urls or encode more than needed.
+		"http://example.com/dav/a/2" + archiveExt,
+		"/dav/a/%33" + archiveExt,
+		"/dav/a/.4" + archiveExt + ".part",
+		"/dav/a/notes.txt",
+		"/dav/a/sub/",
+	}
+
+	names, err := ws.List("a")
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	expected := []string{"a/1" + archiveExt, "a/2" + archiveExt, "a/3" + archiveExt}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("List = %v, expected %v", names, expected)
+	}
+
+	fd.hrefs = []string{"%zz"}
+	if _, err := ws.List("a"); err == nil {
+		t.Errorf("List accepted an invalid href")
+	}
+}
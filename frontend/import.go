@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	gh "github.com/google/go-github/github"
+	"github.com/surma-dump/github-backup/common"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// importConfig describes what is imported for a GitHub user. If tokens are
+// stored, it is saved in the hash <namespace>:imports, so the import can be
+// repeated periodically.
+type importConfig struct {
+	Login   string   `json:"login"`
+	User    bool     `json:"user"`
+	Starred bool     `json:"starred"`
+	Gists   bool     `json:"gists"`
+	Orgs    []string `json:"orgs,omitempty"`
+}
+
+// sources returns the API endpoints listing the repositories to import.
+func (ic *importConfig) sources() []string {
+	urls := []string{}
+	if ic.User {
+		urls = append(urls, "/user/repos")
+	}
+	if ic.Starred {
+		urls = append(urls, "/user/starred")
+	}
+	for _, org := range ic.Orgs {
+		urls = append(urls, "/orgs/"+org+"/repos")
+	}
+	return urls
+}
+
+// empty reports whether ic imports nothing at all.
+func (ic *importConfig) empty() bool {
+	return len(ic.sources()) == 0 && !ic.Gists
+}
+
+// merge adds the sources of other to ic. Sources are never removed by an
+// import, so unticking a box does not make repositories look deleted.
+func (ic *importConfig) merge(other *importConfig) {
+	ic.User = ic.User || other.User
+	ic.Starred = ic.Starred || other.Starred
+	ic.Gists = ic.Gists || other.Gists
+	for _, org := range other.Orgs {
+		if !contains(ic.Orgs, org) {
+			ic.Orgs = append(ic.Orgs, org)
+		}
+	}
+}
+
+// loadImportConfig returns the stored import config of login, or nil if
+// there is none.
+func loadImportConfig(conn redis.Conn, login string) (*importConfig, error) {
+	data, err := redis.Bytes(conn.Do("HGET", *namespace+":imports", login))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf := &importConfig{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("Invalid import configuration for %s: %s", login, err)
+	}
+	return conf, nil
+}
+
+func saveImportConfig(conn redis.Conn, conf *importConfig) error {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", *namespace+":imports", conf.Login, data)
+	return err
+}
+
+// importRepos adds all repositories described by the import config in ctx
+// to the known repositories. If every source could be listed completely,
+// repositories the user imported before but which are missing now are
+// checked for having disappeared upstream.
+func importRepos(ctx context.Context) error {
+	ghAPI := ctx.Value(githubAPIKey).(*gh.Client)
+	conf := ctx.Value(importConfigKey).(*importConfig)
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+
+	ch := make(chan githubRepo)
+	wg := &sync.WaitGroup{}
+	errs := []error{}
+	m := &sync.Mutex{}
+	for _, source := range conf.sources() {
+		wg.Add(1)
+		go func(source string) {
+			defer wg.Done()
+			if err := paginatedRepos(ch, ghAPI, source); err != nil {
+				m.Lock()
+				errs = append(errs, fmt.Errorf("Could not list %s: %s", source, err))
+				m.Unlock()
+			}
+		}(source)
+	}
+	if conf.Gists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := paginatedGists(ch, ghAPI); err != nil {
+				m.Lock()
+				errs = append(errs, fmt.Errorf("Could not list gists: %s", err))
+				m.Unlock()
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	autoOrgs, err := redis.Strings(conn.Do("SMEMBERS", *namespace+":auto_orgs"))
+	if err != nil {
+		log.Printf("Error reading auto-activated organisations: %s", err)
+	}
+	rules, err := loadRules(conn)
+	if err != nil {
+		log.Printf("Error reading activation rules: %s", err)
+	}
+
+	seen := []string{}
+	for repo := range ch {
+		seen = append(seen, *repo.SSHURL)
+		// Saving the metadata first migrates renamed repositories.
+		if err := saveRepoInfo(conn, newRepoInfo(&repo)); err != nil {
+			log.Printf("Error saving to database: %s", err)
+		}
+		added, err := redis.Bool(conn.Do("SADD", *namespace+":known_repos", *repo.SSHURL))
+		if err != nil {
+			log.Printf("Error saving to database: %s", err)
+		}
+		if err := updateDecision(conn, ghAPI, rules, autoOrgs, &repo, added); err != nil {
+			log.Printf("Error saving to database: %s", err)
+		}
+		if repo.CloneURL != nil {
+			if _, err := conn.Do("HSET", *namespace+":clone_urls", *repo.SSHURL, *repo.CloneURL); err != nil {
+				log.Printf("Error saving to database: %s", err)
+			}
+		}
+		// Remember whose token can be used to clone the repository.
+		if sealer != nil {
+			if _, err := conn.Do("HSET", *namespace+":repo_tokens", *repo.SSHURL, conf.Login); err != nil {
+				log.Printf("Error saving to database: %s", err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	if conf.empty() {
+		return nil
+	}
+	return markGone(conn, ghAPI, conf.Login, seen)
+}
+
+// updateDecision activates or deactivates repo according to the rules, the
+// opt-in of its owners or, if it was just added, its organisation. If the
+// opt-in cannot be read, the stored decision is kept, or withdrawing an
+// opt-in later would go unnoticed.
+func updateDecision(conn redis.Conn, ghAPI *gh.Client, rules []*rule, autoOrgs []string, repo *githubRepo, added bool) error {
+	d := decide(rules, repo)
+	var optInErr error
+	if d == nil {
+		if d, optInErr = optIn(conn, ghAPI, repo); optInErr != nil {
+			log.Printf("Error reading opt-in of %s, keeping its decision: %s", *repo.SSHURL, optInErr)
+		}
+	}
+	// Only new repositories are activated for their organisation, so
+	// deactivating one sticks.
+	if owner := repoOwner(*repo.SSHURL); d == nil && added && contains(autoOrgs, owner) {
+		d = &decision{"organisation " + owner, actionActivate}
+	}
+	switch {
+	case d != nil:
+		return applyDecision(conn, *repo.SSHURL, d)
+	case optInErr != nil:
+		return nil
+	}
+	_, err := conn.Do("HDEL", *namespace+":decisions", *repo.SSHURL)
+	return err
+}
+
+// markGone records the repositories login can see in the set
+// <namespace>:imported:<login>. Repositories which were in the set before but
+// are not in seen are looked up with the API. Not being listed any more
+// usually just means the import changed, e.g. a repository was unstarred, so
+// only those the API does not find any more are treated as lost: the token of
+// login is not used for them any more, and unless another user still sees
+// them, they are marked as gone in the hash <namespace>:gone_repos with the
+// time they were noticed missing. Repositories that show up again are
+// unmarked.
+func markGone(conn redis.Conn, ghAPI *gh.Client, login string, seen []string) error {
+	key := *namespace + ":imported:" + login
+	previous, err := redis.Strings(conn.Do("SMEMBERS", key))
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Do("SADD", *namespace+":importers", login); err != nil {
+		return err
+	}
+	importers, err := redis.Strings(conn.Do("SMEMBERS", *namespace+":importers"))
+	if err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, repo := range seen {
+		current[repo] = true
+	}
+	keep := append([]string{}, seen...)
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, repo := range previous {
+		if current[repo] {
+			continue
+		}
+		exists, err := repoExists(conn, ghAPI, repo)
+		if err != nil {
+			// Check again on the next import.
+			log.Printf("Error looking up %s: %s", repo, err)
+			keep = append(keep, repo)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		// The token of login can not be used for the repository any more.
+		owner, err := redis.String(conn.Do("HGET", *namespace+":repo_tokens", repo))
+		if err == nil && owner == login {
+			if _, err := conn.Do("HDEL", *namespace+":repo_tokens", repo); err != nil {
+				return err
+			}
+		}
+
+		visible := false
+		for _, other := range importers {
+			if other == login {
+				continue
+			}
+			if visible, err = redis.Bool(conn.Do("SISMEMBER", *namespace+":imported:"+other, repo)); err != nil {
+				return err
+			}
+			if visible {
+				break
+			}
+		}
+		if visible {
+			continue
+		}
+		log.Printf("%s disappeared upstream", repo)
+		if _, err := conn.Do("HSETNX", *namespace+":gone_repos", repo, now); err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.Do("DEL", key+".new"); err != nil {
+		return err
+	}
+	if len(keep) == 0 {
+		_, err := conn.Do("DEL", key)
+		return err
+	}
+	if _, err := conn.Do("SADD", redis.Args{}.Add(key+".new").AddFlat(keep)...); err != nil {
+		return err
+	}
+	if _, err := conn.Do("RENAME", key+".new", key); err != nil {
+		return err
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	_, err = conn.Do("HDEL", redis.Args{}.Add(*namespace+":gone_repos").AddFlat(seen)...)
+	return err
+}
+
+// repoExists asks the API whether the repository with the SSH url repo can
+// still be found. Repositories are looked up by id if it is known, so
+// renamed ones are found as well.
+func repoExists(conn redis.Conn, ghAPI *gh.Client, repo string) (bool, error) {
+	info, err := loadRepoInfo(conn, repo)
+	if err != nil {
+		return false, err
+	}
+	var endpoint string
+	switch {
+	case strings.HasPrefix(repo, "git@gist.github.com:"):
+		endpoint = "/gists/" + strings.TrimSuffix(strings.TrimPrefix(repo, "git@gist.github.com:"), ".git")
+	case info.ID != 0:
+		endpoint = fmt.Sprintf("/repositories/%d", info.ID)
+	default:
+		endpoint = "/repos/" + strings.TrimSuffix(repo[strings.LastIndex(repo, ":")+1:], ".git")
+	}
+	req, err := ghAPI.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := ghAPI.Do(req, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reimportLoop repeats the stored imports of all users every interval, so
+// new repositories show up without anyone importing them again.
+func reimportLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		pool := root.Value(redisKey).(*redis.Pool)
+		conn := pool.Get()
+		confs, err := redis.StringMap(conn.Do("HGETALL", *namespace+":imports"))
+		conn.Close()
+		if err != nil {
+			log.Printf("Error reading import configurations: %s", err)
+			continue
+		}
+		for login, data := range confs {
+			conf := &importConfig{}
+			if err := json.Unmarshal([]byte(data), conf); err != nil {
+				log.Printf("Invalid import configuration for %s: %s", login, err)
+				continue
+			}
+			if err := reimportRepos(conf); err != nil {
+				log.Printf("Error re-importing repositories of %s: %s", login, err)
+			}
+		}
+	}
+}
+
+// reimportRepos runs the import described by conf with the stored token of
+// the user, saving the token again if it had to be refreshed.
+func reimportRepos(conf *importConfig) error {
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+
+	token, err := common.LoadToken(conn, sealer, *namespace, conf.Login)
+	if err != nil {
+		return err
+	}
+	ts := oauthConfig.TokenSource(oauth2.NoContext, token)
+	ctx := context.WithValue(root, githubAPIKey, newGithubClient(ts))
+	ctx = context.WithValue(ctx, importConfigKey, conf)
+	importErr := importRepos(ctx)
+
+	if fresh, err := ts.Token(); err == nil && fresh.AccessToken != token.AccessToken {
+		if err := common.SaveToken(conn, sealer, *namespace, conf.Login, fresh); err != nil {
+			return err
+		}
+	}
+	return importErr
+}
+
+// paginatedRepos sends all repositories listed at url to ch.
+func paginatedRepos(ch chan githubRepo, ghAPI *gh.Client, url string) error {
+	currentPage := 1
+	for currentPage != 0 {
+		req, err := ghAPI.NewRequest("GET", fmt.Sprintf(url+"?page=%d", currentPage), nil)
+		if err != nil {
+			return fmt.Errorf("Error creating request: %s", err)
+		}
+		repos := []githubRepo{}
+		resp, err := ghAPI.Do(req, &repos)
+		if err != nil {
+			return fmt.Errorf("Error executing request: %s", err)
+		}
+		for _, repo := range repos {
+			ch <- repo
+		}
+		currentPage = resp.NextPage
+	}
+	return nil
+}
+
+// paginatedGists sends the gists of the authenticated user to ch. They are
+// treated like repositories named gist/<id>.
+func paginatedGists(ch chan githubRepo, ghAPI *gh.Client) error {
+	currentPage := 1
+	for currentPage != 0 {
+		req, err := ghAPI.NewRequest("GET", fmt.Sprintf("/gists?page=%d", currentPage), nil)
+		if err != nil {
+			return fmt.Errorf("Error creating request: %s", err)
+		}
+		gists := []struct {
+			ID         string `json:"id"`
+			Public     bool   `json:"public"`
+			GitPullURL string `json:"git_pull_url"`
+		}{}
+		resp, err := ghAPI.Do(req, &gists)
+		if err != nil {
+			return fmt.Errorf("Error executing request: %s", err)
+		}
+		for _, g := range gists {
+			repo := githubRepo{}
+			sshURL := "git@gist.github.com:" + g.ID + ".git"
+			fullName := "gist/" + g.ID
+			private := !g.Public
+			cloneURL := g.GitPullURL
+			repo.SSHURL = &sshURL
+			repo.FullName = &fullName
+			repo.Private = &private
+			repo.CloneURL = &cloneURL
+			ch <- repo
+		}
+		currentPage = resp.NextPage
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
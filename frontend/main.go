@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"sync"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	gh "github.com/google/go-github/github"
@@ -19,17 +21,24 @@ import (
 )
 
 var (
-	listen       = flag.String("listen", "localhost:8080", "Address to bind webserver to")
-	clientID     = flag.String("id", "", "App ID of GitHub app")
-	clientSecret = flag.String("secret", "", "Secret of GitHub app")
-	publicURL    = flag.String("public", "", "Public URL of the app")
-	redisURL     = flag.String("redis", "", "Address of redis")
-	static       = flag.String("static", "static", "Path to static files")
-	namespace    = flag.String("namespace", "github-backup", "Database namespace")
-	help         = flag.Bool("help", false, "Show this help")
-
-	oauthConfig *oauth2.Config
-	root        = context.Background()
+	listen           = flag.String("listen", "localhost:8080", "Address to bind webserver to")
+	clientID         = flag.String("id", "", "App ID of GitHub app")
+	clientSecret     = flag.String("secret", "", "Secret of GitHub app")
+	publicURL        = flag.String("public", "", "Public URL of the app")
+	redisURL         = flag.String("redis", "", "Address of redis")
+	static           = flag.String("static", "static", "Path to static files")
+	namespace        = flag.String("namespace", "github-backup", "Database namespace")
+	reimport         = flag.Duration("reimport", 24*time.Hour, "Interval to repeat imports with the stored tokens in (0 disables)")
+	optInTopic       = flag.String("opt-in-topic", "backup", "GitHub topic that activates repositories (empty disables)")
+	optInFileEnabled = flag.Bool("opt-in-file", false, "Activate or exclude repositories according to their "+optInFile)
+	webhookSecret    = flag.String("webhook-secret", "", "Secret of the GitHub webhook sending repository events to /webhook (empty disables)")
+	masterKey        = flag.String("master-key", "", "Comma separated base64 encoded keys to encrypt secrets in the database with, the first one is used for new secrets (default $"+common.MasterKeyEnv+")")
+	help             = flag.Bool("help", false, "Show this help")
+
+	oauthConfig     *oauth2.Config
+	gistOAuthConfig *oauth2.Config
+	sealer          *common.Sealer
+	root            = context.Background()
 )
 
 type key int
@@ -37,8 +46,7 @@ type key int
 const (
 	redisKey key = iota
 	githubAPIKey
-	importUserRepoKey
-	importStarredRepoKey
+	importConfigKey
 )
 
 func main() {
@@ -56,9 +64,23 @@ func main() {
 		ClientID:     *clientID,
 		ClientSecret: *clientSecret,
 		RedirectURL:  *publicURL + "/callback",
-		Scopes:       []string{"repo"},
+		Scopes:       []string{"repo", "read:org"},
 		Endpoint:     github.Endpoint,
 	}
+	// Only users importing their gists are asked for the gist scope, in a
+	// second authorization.
+	gistOAuthConfig = &oauth2.Config{}
+	*gistOAuthConfig = *oauthConfig
+	gistOAuthConfig.Scopes = []string{"repo", "read:org", "gist"}
+
+	if *masterKey != "" || os.Getenv(common.MasterKeyEnv) != "" {
+		var err error
+		if sealer, err = common.NewSealer(*masterKey); err != nil {
+			log.Fatalf("Invalid master key: %s", err)
+		}
+	} else {
+		log.Printf("No master key given, OAuth tokens will not be stored for cloning")
+	}
 
 	if err := common.CheckRedis(*redisURL); err != nil {
 		log.Fatalf("Could not connect to redis: %s", err)
@@ -67,10 +89,20 @@ func main() {
 	defer pool.Close()
 	root = context.WithValue(root, redisKey, pool)
 
+	if sealer != nil && *reimport > 0 {
+		go reimportLoop(*reimport)
+	}
+
 	http.HandleFunc("/active", active)
 	http.HandleFunc("/activate", activate)
 	http.HandleFunc("/deactivate", deactivate)
 	http.HandleFunc("/repos", listRepos)
+	http.HandleFunc("/gone", goneRepos)
+	http.HandleFunc("/orgs", listOrgs)
+	http.HandleFunc("/rules", editRules)
+	http.HandleFunc("/decisions", listDecisions)
+	http.HandleFunc("/webhook", webhook)
+	http.HandleFunc("/autoactivate", autoActivate)
 	http.HandleFunc("/import", githubImport)
 	http.HandleFunc("/callback", githubCallback)
 
@@ -95,18 +127,12 @@ func active(w http.ResponseWriter, r *http.Request) {
 	conn := pool.Get()
 	defer conn.Close()
 
-	vals, err := redis.Values(conn.Do("SMEMBERS", *namespace+":repos"))
+	repos, err := loadRepoInfos(conn, *namespace+":repos")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	repos := []string{}
-	if err := redis.ScanSlice(vals, &repos); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(repos)
 }
@@ -150,19 +176,29 @@ func listRepos(w http.ResponseWriter, r *http.Request) {
 	conn := pool.Get()
 	defer conn.Close()
 
-	vals, err := redis.Values(conn.Do("SMEMBERS", *namespace+":known_repos"))
+	repos, err := loadRepoInfos(conn, *namespace+":known_repos")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	repos := []string{}
-	if err := redis.ScanSlice(vals, &repos); err != nil {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(repos)
+}
+
+func goneRepos(w http.ResponseWriter, r *http.Request) {
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+
+	gone, err := redis.StringMap(conn.Do("HGETALL", *namespace+":gone_repos"))
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(repos)
+	json.NewEncoder(w).Encode(gone)
 }
 
 func githubImport(w http.ResponseWriter, r *http.Request) {
@@ -170,30 +206,55 @@ func githubImport(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
 }
 
+// newGithubClient creates a GitHub API client authenticating with the tokens
+// of ts.
+func newGithubClient(ts oauth2.TokenSource) *gh.Client {
+	t := &oauth2.Transport{Source: ts}
+	return gh.NewClient(&http.Client{Transport: githubOptIn{t}})
+}
+
+// hasScope reports whether the comma separated list of OAuth scopes
+// contains scope.
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Split(scopes, ",") {
+		if strings.TrimSpace(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
 type githubOptIn struct {
 	http.RoundTripper
 }
 
 func (goi githubOptIn) RoundTrip(r *http.Request) (*http.Response, error) {
-	r.Header.Set("Accept", "application/vnd.github.moondragon+json")
+	// mercy-preview adds the topics of repositories.
+	r.Header.Set("Accept", "application/vnd.github.moondragon+json, application/vnd.github.mercy-preview+json")
 	return goi.RoundTripper.RoundTrip(r)
 }
 
 func githubCallback(w http.ResponseWriter, r *http.Request) {
-	ctx := root
-
 	state, err := url.ParseQuery(r.FormValue("state"))
 	if err != nil {
 		http.Error(w, "Invalid state", http.StatusBadRequest)
 		return
 	}
-	ctx = context.WithValue(ctx, importUserRepoKey, false)
-	if state.Get("user") == "true" {
-		ctx = context.WithValue(ctx, importUserRepoKey, true)
+	conf := &importConfig{
+		User:    state.Get("user") == "true",
+		Starred: state.Get("starred") == "true",
+		Gists:   state.Get("gists") == "true",
 	}
-	ctx = context.WithValue(ctx, importStarredRepoKey, false)
-	if state.Get("starred") == "true" {
-		ctx = context.WithValue(ctx, importStarredRepoKey, true)
+	for _, o := range strings.Split(state.Get("orgs"), ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if !validOrg.MatchString(o) {
+			http.Error(w, "Invalid organisation "+o, http.StatusBadRequest)
+			return
+		}
+		conf.Orgs = append(conf.Orgs, o)
 	}
 
 	token, err := oauthConfig.Exchange(oauth2.NoContext, r.FormValue("code"))
@@ -202,68 +263,69 @@ func githubCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokenSource := oauthConfig.TokenSource(oauth2.NoContext, token)
-	t := &oauth2.Transport{Source: tokenSource}
-	c := &http.Client{Transport: githubOptIn{t}}
-	ghAPI := gh.NewClient(c)
-
-	ctx = context.WithValue(ctx, githubAPIKey, ghAPI)
-	go importRepos(ctx)
-	fmt.Fprintf(w, "<script>window.close();</script>")
-}
+	ghAPI := newGithubClient(oauthConfig.TokenSource(oauth2.NoContext, token))
+	user, resp, err := ghAPI.Users.Get("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conf.Login = *user.Login
+	gistScope := hasScope(resp.Header.Get("X-OAuth-Scopes"), "gist")
 
-func importRepos(ctx context.Context) {
-	ghAPI := ctx.Value(githubAPIKey).(*gh.Client)
 	pool := root.Value(redisKey).(*redis.Pool)
 	conn := pool.Get()
 	defer conn.Close()
-
-	ch := make(chan gh.Repository)
-	wg := &sync.WaitGroup{}
-	if ctx.Value(importUserRepoKey).(bool) {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			paginatedRepos(ch, ghAPI, "/user/repos")
-		}()
-	}
-	if ctx.Value(importStarredRepoKey).(bool) {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			paginatedRepos(ch, ghAPI, "/user/starred")
-		}()
+	if err := saveUserOrgs(conn, ghAPI); err != nil {
+		log.Printf("Error listing organisations of %s: %s", conf.Login, err)
 	}
-
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-
-	for repo := range ch {
-		if _, err := conn.Do("SADD", *namespace+":known_repos", *repo.SSHURL); err != nil {
-			log.Printf("Error saving to database: %s", err)
+	for _, o := range conf.Orgs {
+		if _, err := conn.Do("SADD", *namespace+":orgs", o); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
-}
 
-func paginatedRepos(ch chan gh.Repository, ghAPI *gh.Client, url string) {
-	currentPage := 1
-	for currentPage != 0 {
-		req, err := ghAPI.NewRequest("GET", fmt.Sprintf(url+"?page=%d", currentPage), nil)
+	if sealer != nil {
+		// Earlier imports stay part of the stored config.
+		stored, err := loadImportConfig(conn, conf.Login)
 		if err != nil {
-			log.Printf("Error creating request: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		repos := []gh.Repository{}
-		resp, err := ghAPI.Do(req, &repos)
-		if err != nil {
-			log.Printf("Error executing request: %s", err)
+		if stored != nil {
+			stored.merge(conf)
+			conf = stored
+		}
+	}
+	if conf.Gists && !gistScope {
+		if state.Get("gist_scope") == "" {
+			// Ask for the gist scope, the token is replaced by the new one.
+			state.Set("gist_scope", "requested")
+			target := gistOAuthConfig.AuthCodeURL(state.Encode(), oauth2.ApprovalForce)
+			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+			return
+		}
+		log.Printf("%s did not grant the gist scope, not importing gists", conf.Login)
+		conf.Gists = false
+	}
+
+	if sealer != nil {
+		if err := common.SaveToken(conn, sealer, *namespace, conf.Login, token); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		for _, repo := range repos {
-			ch <- repo
+		if err := saveImportConfig(conn, conf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		currentPage = resp.NextPage
 	}
+
+	ctx := context.WithValue(root, githubAPIKey, ghAPI)
+	ctx = context.WithValue(ctx, importConfigKey, conf)
+	go func() {
+		if err := importRepos(ctx); err != nil {
+			log.Printf("Error importing repositories of %s: %s", conf.Login, err)
+		}
+	}()
+	fmt.Fprintf(w, "<script>window.close();</script>")
 }
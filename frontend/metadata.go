@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// repoInfo is the metadata of a repository. It is stored in the hash
+// <namespace>:repo:<GitHub id>, while the hash <namespace>:repo_ids maps
+// SSH urls (as used in the sets of known and active repositories) to ids.
+type repoInfo struct {
+	ID            int    `json:"id,omitempty" redis:"id"`
+	SSHURL        string `json:"ssh_url" redis:"ssh_url"`
+	FullName      string `json:"full_name,omitempty" redis:"full_name"`
+	Owner         string `json:"owner,omitempty" redis:"owner"`
+	Private       bool   `json:"private" redis:"private"`
+	Fork          bool   `json:"fork" redis:"fork"`
+	Archived      bool   `json:"archived" redis:"archived"`
+	Size          int    `json:"size" redis:"size"`
+	HasWiki       bool   `json:"has_wiki" redis:"has_wiki"`
+	DefaultBranch string `json:"default_branch,omitempty" redis:"default_branch"`
+	PushedAt      string `json:"pushed_at,omitempty" redis:"pushed_at"`
+}
+
+func newRepoInfo(repo *githubRepo) *repoInfo {
+	info := &repoInfo{
+		SSHURL: *repo.SSHURL,
+	}
+	if repo.ID != nil {
+		info.ID = *repo.ID
+	}
+	if repo.FullName != nil {
+		info.FullName = *repo.FullName
+	}
+	if repo.Owner != nil && repo.Owner.Login != nil {
+		info.Owner = *repo.Owner.Login
+	}
+	if repo.Private != nil {
+		info.Private = *repo.Private
+	}
+	if repo.Fork != nil {
+		info.Fork = *repo.Fork
+	}
+	if repo.Archived != nil {
+		info.Archived = *repo.Archived
+	}
+	if repo.Size != nil {
+		info.Size = *repo.Size
+	}
+	if repo.HasWiki != nil {
+		info.HasWiki = *repo.HasWiki
+	}
+	if repo.DefaultBranch != nil {
+		info.DefaultBranch = *repo.DefaultBranch
+	}
+	if repo.PushedAt != nil {
+		info.PushedAt = repo.PushedAt.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+func repoKey(id int) string {
+	return *namespace + ":repo:" + strconv.Itoa(id)
+}
+
+// saveRepoInfo stores info. If the repository was known under a different
+// url before, it is migrated to the new one.
+func saveRepoInfo(conn redis.Conn, info *repoInfo) error {
+	if info.ID == 0 {
+		return nil
+	}
+	old, err := redis.String(conn.Do("HGET", repoKey(info.ID), "ssh_url"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if old != "" && old != info.SSHURL {
+		if err := migrateRepo(conn, old, info.SSHURL); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Do("HMSET", redis.Args{}.Add(repoKey(info.ID)).AddFlat(info)...); err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", *namespace+":repo_ids", info.SSHURL, info.ID)
+	return err
+}
+
+// loadRepoInfo returns the metadata of the repository with the SSH url repo.
+// Repositories without stored metadata (e.g. activated by hand) only have
+// their url set.
+func loadRepoInfo(conn redis.Conn, repo string) (*repoInfo, error) {
+	info := &repoInfo{SSHURL: repo}
+	id, err := redis.Int(conn.Do("HGET", *namespace+":repo_ids", repo))
+	if err == redis.ErrNil {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	vals, err := redis.Values(conn.Do("HGETALL", repoKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	if err := redis.ScanStruct(vals, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// loadRepoInfos returns the metadata of all repositories in the set key.
+func loadRepoInfos(conn redis.Conn, key string) ([]*repoInfo, error) {
+	repos, err := redis.Strings(conn.Do("SMEMBERS", key))
+	if err != nil {
+		return nil, err
+	}
+	infos := []*repoInfo{}
+	for _, repo := range repos {
+		info, err := loadRepoInfo(conn, repo)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	gh "github.com/google/go-github/github"
+)
+
+// Repository owners can opt their repositories in by adding the topic given
+// with -opt-in-topic, or, with -opt-in-file, by committing a file
+// .github-backup.yml containing "backup: true" (or "backup: false" to opt
+// out). Removing the topic or file deactivates the repository again.
+
+const optInFile = ".github-backup.yml"
+
+// readOptInFile returns the value of the backup key of the opt-in file of
+// repo. found is false if the repository has no such file.
+func readOptInFile(ghAPI *gh.Client, repo *githubRepo) (backup, found bool, err error) {
+	if repo.Owner == nil || repo.Owner.Login == nil || repo.Name == nil {
+		return false, false, nil
+	}
+	file, _, resp, err := ghAPI.Repositories.GetContents(*repo.Owner.Login, *repo.Name, optInFile, nil)
+	// Empty repositories return 409.
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if file == nil {
+		return false, false, fmt.Errorf("%s is a directory", optInFile)
+	}
+	data, err := file.Decode()
+	if err != nil {
+		return false, false, err
+	}
+	return parseOptInFile(data)
+}
+
+// parseOptInFile reads the top level backup key from the YAML in data.
+func parseOptInFile(data []byte) (backup, found bool, err error) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "backup" || strings.HasPrefix(parts[0], " ") {
+			continue
+		}
+		switch strings.ToLower(strings.Trim(strings.TrimSpace(parts[1]), `"'`)) {
+		case "true", "yes", "on":
+			return true, true, nil
+		case "false", "no", "off":
+			return false, true, nil
+		default:
+			return false, false, fmt.Errorf("Invalid value for backup in %s: %s", optInFile, strings.TrimSpace(parts[1]))
+		}
+	}
+	return false, false, nil
+}
+
+func loadDecision(conn redis.Conn, repo string) (*decision, error) {
+	data, err := redis.Bytes(conn.Do("HGET", *namespace+":decisions", repo))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &decision{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// optIn returns the decision made by the owners of repo, or nil if they did
+// not make one.
+func optIn(conn redis.Conn, ghAPI *gh.Client, repo *githubRepo) (*decision, error) {
+	if *optInFileEnabled {
+		backup, found, err := readOptInFile(ghAPI, repo)
+		if err != nil {
+			return nil, err
+		}
+		if found && backup {
+			return &decision{optInFile, actionActivate}, nil
+		}
+		if found {
+			return &decision{optInFile, actionExclude}, nil
+		}
+	}
+	topic := "topic " + *optInTopic
+	if *optInTopic != "" && contains(repo.Topics, *optInTopic) {
+		return &decision{topic, actionActivate}, nil
+	}
+
+	// The owners withdrew their opt-in.
+	previous, err := loadDecision(conn, *repo.SSHURL)
+	if err != nil || previous == nil {
+		return nil, err
+	}
+	if previous.Action == actionActivate && (previous.Rule == topic || previous.Rule == optInFile) {
+		return &decision{previous.Rule + " removed", actionExclude}, nil
+	}
+	if strings.HasSuffix(previous.Rule, " removed") {
+		return previous, nil
+	}
+	return nil, nil
+}
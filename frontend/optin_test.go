@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	gh "github.com/google/go-github/github"
+)
+
+// newTestAPI returns a GitHub client talking to handler.
+func newTestAPI(handler http.HandlerFunc) (*gh.Client, func()) {
+	server := httptest.NewServer(handler)
+	client := gh.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	return client, server.Close
+}
+
+// optInAPI serves the opt-in file of owner/repo with the given content. An
+// empty content is served as a missing file, status overrides the response.
+func optInAPI(content string, status int) (*gh.Client, func()) {
+	return newTestAPI(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/owner/repo/contents/"+optInFile {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case status != 0:
+			http.Error(w, `{"message": "error"}`, status)
+		case content == "":
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		default:
+			json.NewEncoder(w).Encode(map[string]string{
+				"type":     "file",
+				"encoding": "base64",
+				"content":  base64.StdEncoding.EncodeToString([]byte(content)),
+			})
+		}
+	})
+}
+
+func testRepo(topics ...string) *githubRepo {
+	login, name, sshURL, fullName := "owner", "repo", "git@github.com:owner/repo.git", "owner/repo"
+	return &githubRepo{
+		Repository: gh.Repository{
+			Owner:    &gh.User{Login: &login},
+			Name:     &name,
+			FullName: &fullName,
+			SSHURL:   &sshURL,
+		},
+		Topics: topics,
+	}
+}
+
+func TestParseOptInFile(t *testing.T) {
+	tests := []struct {
+		content       string
+		backup, found bool
+		err           bool
+	}{
+		{"backup: true\n", true, true, false},
+		{"backup: yes", true, true, false},
+		{"backup: 'on' # comment", true, true, false},
+		{"other: 1\nbackup: false\n", false, true, false},
+		{`backup: "No"`, false, true, false},
+		{"# backup: true\n", false, false, false},
+		{"nested:\n  backup: true\n", false, false, false},
+		{"backups: true", false, false, false},
+		{"", false, false, false},
+		{"backup: maybe", false, false, true},
+	}
+	for _, test := range tests {
+		backup, found, err := parseOptInFile([]byte(test.content))
+		if backup != test.backup || found != test.found || (err != nil) != test.err {
+			t.Errorf("parseOptInFile(%q) = %v, %v, %v, expected %v, %v, error %v", test.content, backup, found, err, test.backup, test.found, test.err)
+		}
+	}
+}
+
+func TestOptIn(t *testing.T) {
+	oldFile, oldTopic := *optInFileEnabled, *optInTopic
+	defer func() { *optInFileEnabled, *optInTopic = oldFile, oldTopic }()
+	*optInFileEnabled, *optInTopic = true, "backup"
+
+	activatedByFile := &decision{optInFile, actionActivate}
+	activatedByTopic := &decision{"topic backup", actionActivate}
+	tests := []struct {
+		name     string
+		file     string
+		topics   []string
+		previous *decision
+		expected *decision
+	}{
+		{"file opts in", "backup: true", nil, nil, activatedByFile},
+		{"file opts out", "backup: false", []string{"backup"}, nil, &decision{optInFile, actionExclude}},
+		{"topic", "", []string{"backup"}, nil, activatedByTopic},
+		{"no opt-in", "", []string{"other"}, nil, nil},
+		{"file removed", "", nil, activatedByFile, &decision{optInFile + " removed", actionExclude}},
+		{"topic removed", "", nil, activatedByTopic, &decision{"topic backup removed", actionExclude}},
+		{"still removed", "", nil, &decision{"topic backup removed", actionExclude}, &decision{"topic backup removed", actionExclude}},
+		{"other decision", "", nil, &decision{"rule", actionActivate}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ghAPI, done := optInAPI(test.file, 0)
+			defer done()
+			conn := newFakeConn()
+			if test.previous != nil {
+				data, _ := json.Marshal(test.previous)
+				conn.Do("HSET", *namespace+":decisions", "git@github.com:owner/repo.git", data)
+			}
+			d, err := optIn(conn, ghAPI, testRepo(test.topics...))
+			if err != nil {
+				t.Fatalf("optIn failed: %s", err)
+			}
+			if fmt.Sprint(d) != fmt.Sprint(test.expected) {
+				t.Errorf("optIn = %v, expected %v", d, test.expected)
+			}
+		})
+	}
+}
+
+func TestUpdateDecisionKeepsOptInOnError(t *testing.T) {
+	oldFile := *optInFileEnabled
+	defer func() { *optInFileEnabled = oldFile }()
+	*optInFileEnabled = true
+
+	repo := testRepo()
+	conn := newFakeConn()
+	if err := applyDecision(conn, *repo.SSHURL, &decision{optInFile, actionActivate}); err != nil {
+		t.Fatal(err)
+	}
+
+	ghAPI, done := optInAPI("", http.StatusInternalServerError)
+	defer done()
+	if err := updateDecision(conn, ghAPI, nil, nil, repo, false); err != nil {
+		t.Fatalf("updateDecision failed: %s", err)
+	}
+	d, err := loadDecision(conn, *repo.SSHURL)
+	if err != nil || d == nil || d.Rule != optInFile {
+		t.Fatalf("Decision after a failed opt-in lookup is %v, %v", d, err)
+	}
+
+	// Once the file can be read again, its removal is noticed.
+	ghAPI, done = optInAPI("", 0)
+	defer done()
+	if err := updateDecision(conn, ghAPI, nil, nil, repo, false); err != nil {
+		t.Fatalf("updateDecision failed: %s", err)
+	}
+	if active, _ := conn.Do("SISMEMBER", *namespace+":repos", *repo.SSHURL); active != int64(0) {
+		t.Errorf("Repository is still active after its opt-in file was removed")
+	}
+}
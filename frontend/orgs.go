@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	gh "github.com/google/go-github/github"
+)
+
+// Organisations the importing users are members of (or imported explicitly)
+// are kept in the set <namespace>:orgs, so the UI can offer them. All
+// current and future repositories of organisations in <namespace>:auto_orgs
+// are activated automatically.
+
+// validOrg matches GitHub organisation names.
+var validOrg = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+type org struct {
+	Name         string `json:"name"`
+	AutoActivate bool   `json:"auto_activate"`
+}
+
+// saveUserOrgs remembers the organisations the user of ghAPI is a member of.
+func saveUserOrgs(conn redis.Conn, ghAPI *gh.Client) error {
+	opt := &gh.ListOptions{PerPage: 100}
+	for {
+		orgs, resp, err := ghAPI.Organizations.List("", opt)
+		if err != nil {
+			return err
+		}
+		for _, o := range orgs {
+			if _, err := conn.Do("SADD", *namespace+":orgs", *o.Login); err != nil {
+				return err
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// repoOwner returns the owner of a repository given by its SSH url
+// (git@github.com:owner/name.git).
+func repoOwner(repo string) string {
+	p := repo[strings.LastIndex(repo, ":")+1:]
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+func listOrgs(w http.ResponseWriter, r *http.Request) {
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+
+	names, err := redis.Strings(conn.Do("SMEMBERS", *namespace+":orgs"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	orgs := []org{}
+	for _, name := range names {
+		auto, err := redis.Bool(conn.Do("SISMEMBER", *namespace+":auto_orgs", name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		orgs = append(orgs, org{name, auto})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// autoActivate enables or disables the auto-activation of an organisation's
+// repositories. When enabled, all its known repositories are activated right
+// away.
+func autoActivate(w http.ResponseWriter, r *http.Request) {
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+	name := r.FormValue("org")
+
+	if name == "" {
+		http.Error(w, "org query parameter missing", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("enabled") != "true" {
+		if _, err := conn.Do("SREM", *namespace+":auto_orgs", name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "", http.StatusNoContent)
+		return
+	}
+
+	if _, err := conn.Do("SADD", *namespace+":auto_orgs", name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	repos, err := redis.Strings(conn.Do("SMEMBERS", *namespace+":known_repos"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, repo := range repos {
+		if repoOwner(repo) != name {
+			continue
+		}
+		if _, err := conn.Do("SADD", *namespace+":repos", repo); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("Auto-activating repositories of %s", name)
+	http.Error(w, "", http.StatusNoContent)
+}
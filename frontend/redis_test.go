@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// fakeConn is a redis.Conn keeping strings, hashes, sets and lists in
+// memory. It supports the commands the frontend uses.
+type fakeConn struct {
+	keys map[string]interface{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{keys: map[string]interface{}{}}
+}
+
+func argString(a interface{}) string {
+	switch v := a.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(a)
+}
+
+func (fc *fakeConn) hash(key string) map[string]string {
+	h, ok := fc.keys[key].(map[string]string)
+	if !ok {
+		h = map[string]string{}
+		fc.keys[key] = h
+	}
+	return h
+}
+
+func (fc *fakeConn) set(key string) map[string]bool {
+	s, ok := fc.keys[key].(map[string]bool)
+	if !ok {
+		s = map[string]bool{}
+		fc.keys[key] = s
+	}
+	return s
+}
+
+// cleanup drops empty hashes, sets and lists like Redis does.
+func (fc *fakeConn) cleanup(key string) {
+	switch v := fc.keys[key].(type) {
+	case map[string]string:
+		if len(v) == 0 {
+			delete(fc.keys, key)
+		}
+	case map[string]bool:
+		if len(v) == 0 {
+			delete(fc.keys, key)
+		}
+	case []string:
+		if len(v) == 0 {
+			delete(fc.keys, key)
+		}
+	}
+}
+
+func bulk(s string) interface{} {
+	return []byte(s)
+}
+
+func boolInt(b bool) interface{} {
+	if b {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func (fc *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	s := make([]string, len(args))
+	for i, a := range args {
+		s[i] = argString(a)
+	}
+	if len(s) > 0 {
+		defer fc.cleanup(s[0])
+	}
+	switch cmd {
+	case "GET":
+		v, ok := fc.keys[s[0]].(string)
+		if !ok {
+			return nil, nil
+		}
+		return bulk(v), nil
+	case "SET":
+		fc.keys[s[0]] = s[1]
+		return "OK", nil
+	case "DEL":
+		n := 0
+		for _, k := range s {
+			if _, ok := fc.keys[k]; ok {
+				delete(fc.keys, k)
+				n++
+			}
+		}
+		return int64(n), nil
+	case "EXISTS":
+		_, ok := fc.keys[s[0]]
+		return boolInt(ok), nil
+	case "RENAMENX":
+		if _, ok := fc.keys[s[1]]; ok {
+			return int64(0), nil
+		}
+		fc.keys[s[1]] = fc.keys[s[0]]
+		delete(fc.keys, s[0])
+		return int64(1), nil
+	case "HGET":
+		v, ok := fc.hash(s[0])[s[1]]
+		if !ok {
+			return nil, nil
+		}
+		return bulk(v), nil
+	case "HEXISTS":
+		_, ok := fc.hash(s[0])[s[1]]
+		return boolInt(ok), nil
+	case "HSET", "HMSET":
+		h := fc.hash(s[0])
+		for i := 1; i+1 < len(s); i += 2 {
+			h[s[i]] = s[i+1]
+		}
+		return "OK", nil
+	case "HSETNX":
+		h := fc.hash(s[0])
+		if _, ok := h[s[1]]; ok {
+			return int64(0), nil
+		}
+		h[s[1]] = s[2]
+		return int64(1), nil
+	case "HDEL":
+		h := fc.hash(s[0])
+		n := 0
+		for _, f := range s[1:] {
+			if _, ok := h[f]; ok {
+				delete(h, f)
+				n++
+			}
+		}
+		return int64(n), nil
+	case "HGETALL":
+		values := []interface{}{}
+		for k, v := range fc.hash(s[0]) {
+			values = append(values, bulk(k), bulk(v))
+		}
+		return values, nil
+	case "SADD", "SREM":
+		set := fc.set(s[0])
+		n := 0
+		for _, m := range s[1:] {
+			if set[m] != (cmd == "SADD") {
+				n++
+			}
+			if cmd == "SADD" {
+				set[m] = true
+			} else {
+				delete(set, m)
+			}
+		}
+		return int64(n), nil
+	case "SISMEMBER":
+		return boolInt(fc.set(s[0])[s[1]]), nil
+	case "SMEMBERS":
+		members := []string{}
+		for m := range fc.set(s[0]) {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		values := []interface{}{}
+		for _, m := range members {
+			values = append(values, bulk(m))
+		}
+		return values, nil
+	case "RPUSH", "LPUSH":
+		l, _ := fc.keys[s[0]].([]string)
+		for _, v := range s[1:] {
+			if cmd == "RPUSH" {
+				l = append(l, v)
+			} else {
+				l = append([]string{v}, l...)
+			}
+		}
+		fc.keys[s[0]] = l
+		return int64(len(l)), nil
+	case "LRANGE":
+		l, _ := fc.keys[s[0]].([]string)
+		start, _ := strconv.Atoi(s[1])
+		stop, _ := strconv.Atoi(s[2])
+		if stop < 0 {
+			stop += len(l)
+		}
+		values := []interface{}{}
+		for i := start; i <= stop && i < len(l); i++ {
+			values = append(values, bulk(l[i]))
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("Unexpected command %s", cmd)
+}
+
+func (fc *fakeConn) Close() error                               { return nil }
+func (fc *fakeConn) Err() error                                 { return nil }
+func (fc *fakeConn) Send(cmd string, args ...interface{}) error { return fmt.Errorf("Not supported") }
+func (fc *fakeConn) Flush() error                               { return nil }
+func (fc *fakeConn) Receive() (interface{}, error)              { return nil, fmt.Errorf("Not supported") }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Renamed or transferred repositories keep their GitHub id but get a new
+// SSH url. When an import or the repository webhook reveals the new url, all
+// state stored under the old one is moved over, and the rename is recorded
+// in the hash <namespace>:renames (old url to new url).
+
+// moveMember replaces old with new in the set key, if old is a member.
+func moveMember(conn redis.Conn, key, old, new string) error {
+	removed, err := redis.Bool(conn.Do("SREM", key, old))
+	if err != nil || !removed {
+		return err
+	}
+	_, err = conn.Do("SADD", key, new)
+	return err
+}
+
+// moveField moves the field old of the hash key to new, unless new exists
+// already.
+func moveField(conn redis.Conn, key, old, new string) error {
+	val, err := conn.Do("HGET", key, old)
+	if err != nil || val == nil {
+		return err
+	}
+	if _, err := conn.Do("HSETNX", key, new, val); err != nil {
+		return err
+	}
+	_, err = conn.Do("HDEL", key, old)
+	return err
+}
+
+// moveKey renames the key old to new, unless new exists already, in which
+// case old is dropped.
+func moveKey(conn redis.Conn, old, new string) error {
+	exists, err := redis.Bool(conn.Do("EXISTS", old))
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := conn.Do("RENAMENX", old, new); err != nil {
+		return err
+	}
+	_, err = conn.Do("DEL", old)
+	return err
+}
+
+// prependList moves the elements of the list old to the front of the list
+// new.
+func prependList(conn redis.Conn, old, new string) error {
+	elems, err := redis.Strings(conn.Do("LRANGE", old, 0, -1))
+	if err != nil {
+		return err
+	}
+	for i := len(elems) - 1; i >= 0; i-- {
+		if _, err := conn.Do("LPUSH", new, elems[i]); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("DEL", old)
+	return err
+}
+
+// migrateRepo moves the activation, settings and backup history of the
+// repository old to new. The snapshot list of old is prepended to that of
+// new, so its archives stay reachable. They remain in the old directory,
+// where they are not pruned.
+func migrateRepo(conn redis.Conn, old, new string) error {
+	log.Printf("%s was renamed to %s", old, new)
+	importers, err := redis.Strings(conn.Do("SMEMBERS", *namespace+":importers"))
+	if err != nil {
+		return err
+	}
+	sets := []string{*namespace + ":known_repos", *namespace + ":repos"}
+	for _, login := range importers {
+		sets = append(sets, *namespace+":imported:"+login)
+	}
+	for _, key := range sets {
+		if err := moveMember(conn, key, old, new); err != nil {
+			return err
+		}
+	}
+
+	hashes := []string{"decisions", "clone_urls", "repo_tokens", "gone_repos", "repo_ids", "archive_index", "not_found"}
+	for _, h := range hashes {
+		if err := moveField(conn, *namespace+":"+h, old, new); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range []string{"snapshots", "events"} {
+		if err := prependList(conn, *namespace+":"+k+":"+old, *namespace+":"+k+":"+new); err != nil {
+			return err
+		}
+	}
+	// The state of new is more recent, if there is any. If new has a base of
+	// metadata exports already, the one of old does not need protection.
+	newBase, err := redis.Bool(conn.Do("EXISTS", *namespace+":metadata:"+new))
+	if err != nil {
+		return err
+	}
+	if newBase {
+		oldBase, err := redis.String(conn.Do("HGET", *namespace+":metadata:"+old, "full_snapshot"))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		if oldBase != "" {
+			if _, err := conn.Do("SREM", *namespace+":protected_metadata", oldBase); err != nil {
+				return err
+			}
+		}
+	}
+	for _, k := range []string{"status", "refs", "metadata"} {
+		if err := moveKey(conn, *namespace+":"+k+":"+old, *namespace+":"+k+":"+new); err != nil {
+			return err
+		}
+	}
+	// Release assets and LFS objects are recorded per destination.
+	dests, err := redis.Strings(conn.Do("SMEMBERS", *namespace+":destinations"))
+	if err != nil {
+		return err
+	}
+	for _, d := range dests {
+		for _, k := range []string{"assets", "lfs"} {
+			prefix := *namespace + ":" + k + ":" + d + ":"
+			if err := moveKey(conn, prefix+old, prefix+new); err != nil {
+				return err
+			}
+		}
+	}
+	// A tombstone of old is wrong now that the repository was found again.
+	// Its snapshots stay protected.
+	if _, err := conn.Do("HDEL", *namespace+":tombstones", old); err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", *namespace+":renames", old, new)
+	return err
+}
+
+// validSignature checks the X-Hub-Signature-256 header GitHub signs webhook
+// deliveries with.
+func validSignature(body []byte, header, secret string) bool {
+	if !strings.HasPrefix(header, "sha256=") {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// webhook receives repository events from GitHub, so renames and transfers
+// are picked up right away instead of at the next import.
+func webhook(w http.ResponseWriter, r *http.Request) {
+	if *webhookSecret == "" {
+		http.Error(w, "Webhooks are disabled", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validSignature(body, r.Header.Get("X-Hub-Signature-256"), *webhookSecret) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-GitHub-Event") != "repository" {
+		http.Error(w, "", http.StatusNoContent)
+		return
+	}
+
+	event := struct {
+		Action     string     `json:"action"`
+		Repository githubRepo `json:"repository"`
+	}{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (event.Action != "renamed" && event.Action != "transferred") || event.Repository.SSHURL == nil {
+		http.Error(w, "", http.StatusNoContent)
+		return
+	}
+
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+	if err := saveRepoInfo(conn, newRepoInfo(&event.Repository)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if event.Repository.CloneURL != nil {
+		if _, err := conn.Do("HSET", *namespace+":clone_urls", *event.Repository.SSHURL, *event.Repository.CloneURL); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Error(w, "", http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestMigrateRepo(t *testing.T) {
+	old, new := "git@github.com:owner/old.git", "git@github.com:owner/new.git"
+	ns := *namespace + ":"
+	conn := newFakeConn()
+	setup := [][]interface{}{
+		{"SADD", ns + "importers", "alice"},
+		{"SADD", ns + "destinations", "ftp", "nas"},
+		{"SADD", ns + "known_repos", old},
+		{"SADD", ns + "repos", old},
+		{"SADD", ns + "imported:alice", old},
+		{"HSET", ns + "decisions", old, `{"rule":"ours","action":"activate"}`},
+		{"HSET", ns + "clone_urls", old, "https://github.com/owner/old.git"},
+		{"HSET", ns + "repo_tokens", old, "alice"},
+		{"HSET", ns + "gone_repos", old, "1"},
+		{"HSET", ns + "repo_ids", old, "42"},
+		{"HSET", ns + "archive_index", old, "github.com/owner/old.git"},
+		{"HSET", ns + "not_found", old, "2"},
+		{"HSET", ns + "tombstones", old, "2015-03-04T05:06:07Z"},
+		{"RPUSH", ns + "snapshots:" + old, "a1", "a2"},
+		{"RPUSH", ns + "events:" + old, "e1"},
+		{"HSET", ns + "status:" + old, "ftp", "ok"},
+		{"SET", ns + "refs:" + old, "{}"},
+		{"HSET", ns + "metadata:" + old, "full_snapshot", "a1"},
+		{"HSET", ns + "assets:ftp:" + old, "1", "stored"},
+		{"HSET", ns + "lfs:nas:" + old, "oid", "stored"},
+		// Snapshots of new are kept after those of old.
+		{"RPUSH", ns + "snapshots:" + new, "b1"},
+	}
+	for _, cmd := range setup {
+		if _, err := conn.Do(cmd[0].(string), cmd[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateRepo(conn, old, new); err != nil {
+		t.Fatalf("migrateRepo failed: %s", err)
+	}
+
+	for key, v := range conn.keys {
+		if strings.Contains(key, old) {
+			t.Errorf("%s is left behind", key)
+		}
+		switch v := v.(type) {
+		case map[string]string:
+			if _, ok := v[old]; ok && key != ns+"renames" {
+				t.Errorf("%s still has a field for the old url", key)
+			}
+		case map[string]bool:
+			if v[old] {
+				t.Errorf("%s still contains the old url", key)
+			}
+		}
+	}
+
+	for _, key := range []string{"known_repos", "repos", "imported:alice"} {
+		if member, _ := redis.Bool(conn.Do("SISMEMBER", ns+key, new)); !member {
+			t.Errorf("%s does not contain the new url", key)
+		}
+	}
+	for _, key := range []string{"decisions", "clone_urls", "repo_tokens", "gone_repos", "repo_ids", "archive_index", "not_found"} {
+		if exists, _ := redis.Bool(conn.Do("HEXISTS", ns+key, new)); !exists {
+			t.Errorf("%s has no field for the new url", key)
+		}
+	}
+	for _, key := range []string{"events", "status", "refs", "metadata", "assets:ftp", "lfs:nas"} {
+		if exists, _ := redis.Bool(conn.Do("EXISTS", ns+key+":"+new)); !exists {
+			t.Errorf("%s:%s does not exist", key, new)
+		}
+	}
+	if snapshots, _ := redis.Strings(conn.Do("LRANGE", ns+"snapshots:"+new, 0, -1)); !reflect.DeepEqual(snapshots, []string{"a1", "a2", "b1"}) {
+		t.Errorf("Snapshots of the new url are %v", snapshots)
+	}
+	if exists, _ := redis.Bool(conn.Do("HEXISTS", ns+"tombstones", new)); exists {
+		t.Errorf("The tombstone was moved to the new url")
+	}
+	if renamed, _ := redis.String(conn.Do("HGET", ns+"renames", old)); renamed != new {
+		t.Errorf("Rename recorded as %q", renamed)
+	}
+}
+
+func TestMigrateRepoKeepsNewState(t *testing.T) {
+	old, new := "git@github.com:owner/old.git", "git@github.com:owner/new.git"
+	ns := *namespace + ":"
+	conn := newFakeConn()
+	conn.Do("HSET", ns+"metadata:"+old, "full_snapshot", "a1")
+	conn.Do("HSET", ns+"metadata:"+new, "full_snapshot", "b1")
+	conn.Do("SADD", ns+"protected_metadata", "a1", "b1")
+	conn.Do("HSET", ns+"repo_ids", old, "41")
+	conn.Do("HSET", ns+"repo_ids", new, "42")
+
+	if err := migrateRepo(conn, old, new); err != nil {
+		t.Fatalf("migrateRepo failed: %s", err)
+	}
+	if base, _ := redis.String(conn.Do("HGET", ns+"metadata:"+new, "full_snapshot")); base != "b1" {
+		t.Errorf("Metadata base of the new url is %q", base)
+	}
+	if protected, _ := redis.Strings(conn.Do("SMEMBERS", ns+"protected_metadata")); !reflect.DeepEqual(protected, []string{"b1"}) {
+		t.Errorf("Protected metadata bases are %v", protected)
+	}
+	if id, _ := redis.String(conn.Do("HGET", ns+"repo_ids", new)); id != "42" {
+		t.Errorf("Id of the new url is %q", id)
+	}
+	if exists, _ := redis.Bool(conn.Do("EXISTS", ns+"metadata:"+old)); exists {
+		t.Errorf("Metadata of the old url is left behind")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+
+	"github.com/garyburd/redigo/redis"
+	gh "github.com/google/go-github/github"
+)
+
+// githubRepo adds the fields to gh.Repository which the vendored client
+// does not know about yet.
+type githubRepo struct {
+	gh.Repository
+	Archived *bool    `json:"archived,omitempty"`
+	Topics   []string `json:"topics,omitempty"`
+}
+
+const (
+	actionActivate = "activate"
+	actionExclude  = "exclude"
+)
+
+// rule activates or excludes the repositories matching all of its
+// conditions. Rules are stored as a JSON list in <namespace>:rules and
+// evaluated in order, the first matching rule decides.
+type rule struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Glob and Regexp are matched against owner/name.
+	Glob     string `json:"glob,omitempty"`
+	Regexp   string `json:"regexp,omitempty"`
+	Fork     *bool  `json:"fork,omitempty"`
+	Archived *bool  `json:"archived,omitempty"`
+	Private  *bool  `json:"private,omitempty"`
+	// Sizes are in KB, as reported by GitHub.
+	MinSize int `json:"min_size,omitempty"`
+	MaxSize int `json:"max_size,omitempty"`
+	// The repository needs to have one of Topics.
+	Topics []string `json:"topics,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (r *rule) compile() error {
+	if r.Action != actionActivate && r.Action != actionExclude {
+		return fmt.Errorf("Rule %s: action has to be %s or %s", r.Name, actionActivate, actionExclude)
+	}
+	if _, err := path.Match(r.Glob, ""); err != nil {
+		return fmt.Errorf("Rule %s: invalid glob: %s", r.Name, err)
+	}
+	if r.Regexp != "" {
+		re, err := regexp.Compile(r.Regexp)
+		if err != nil {
+			return fmt.Errorf("Rule %s: invalid regexp: %s", r.Name, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func boolMatches(want *bool, have *bool) bool {
+	return want == nil || (have != nil && *want == *have)
+}
+
+func (r *rule) matches(repo *githubRepo) bool {
+	name := ""
+	if repo.FullName != nil {
+		name = *repo.FullName
+	}
+	if r.Glob != "" {
+		if ok, _ := path.Match(r.Glob, name); !ok {
+			return false
+		}
+	}
+	if r.re != nil && !r.re.MatchString(name) {
+		return false
+	}
+	if !boolMatches(r.Fork, repo.Fork) || !boolMatches(r.Archived, repo.Archived) || !boolMatches(r.Private, repo.Private) {
+		return false
+	}
+	size := 0
+	if repo.Size != nil {
+		size = *repo.Size
+	}
+	if (r.MinSize > 0 && size < r.MinSize) || (r.MaxSize > 0 && size > r.MaxSize) {
+		return false
+	}
+	if len(r.Topics) > 0 {
+		found := false
+		for _, t := range r.Topics {
+			found = found || contains(repo.Topics, t)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func loadRules(conn redis.Conn) ([]*rule, error) {
+	data, err := redis.Bytes(conn.Do("GET", *namespace+":rules"))
+	if err == redis.ErrNil {
+		return []*rule{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseRules(data)
+}
+
+func parseRules(data []byte) ([]*rule, error) {
+	rules := []*rule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Invalid rules: %s", err)
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// decision records which rule activated or excluded a repository. They are
+// kept in the hash <namespace>:decisions.
+type decision struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+}
+
+// decide returns the decision of the first rule matching repo, or nil.
+func decide(rules []*rule, repo *githubRepo) *decision {
+	for _, r := range rules {
+		if r.matches(repo) {
+			return &decision{r.Name, r.Action}
+		}
+	}
+	return nil
+}
+
+// applyDecision activates or deactivates repo according to d. It does
+// nothing if the same decision was applied before, so changes made by hand
+// are kept until the outcome of the rules changes.
+func applyDecision(conn redis.Conn, repo string, d *decision) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	old, err := redis.String(conn.Do("HGET", *namespace+":decisions", repo))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if old == string(data) {
+		return nil
+	}
+	if _, err := conn.Do("HSET", *namespace+":decisions", repo, data); err != nil {
+		return err
+	}
+	cmd := "SADD"
+	if d.Action == actionExclude {
+		cmd = "SREM"
+	}
+	_, err = conn.Do(cmd, *namespace+":repos", repo)
+	return err
+}
+
+// editRules returns the activation rules or, on PUT, replaces them.
+func editRules(w http.ResponseWriter, r *http.Request) {
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+
+	if r.Method == "PUT" || r.Method == "POST" {
+		data := &json.RawMessage{}
+		if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := parseRules(*data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := conn.Do("SET", *namespace+":rules", []byte(*data)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "", http.StatusNoContent)
+		return
+	}
+
+	rs, err := loadRules(conn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rs)
+}
+
+func listDecisions(w http.ResponseWriter, r *http.Request) {
+	pool := root.Value(redisKey).(*redis.Pool)
+	conn := pool.Get()
+	defer conn.Close()
+
+	vals, err := redis.StringMap(conn.Do("HGETALL", *namespace+":decisions"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ds := map[string]*decision{}
+	for repo, data := range vals {
+		d := &decision{}
+		if err := json.Unmarshal([]byte(data), d); err != nil {
+			continue
+		}
+		ds[repo] = d
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ds)
+}
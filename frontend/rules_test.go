@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+
+	gh "github.com/google/go-github/github"
+)
+
+func ruleRepo(fullName string, fork, archived, private bool, size int, topics ...string) *githubRepo {
+	return &githubRepo{
+		Repository: gh.Repository{
+			FullName: &fullName,
+			Fork:     &fork,
+			Private:  &private,
+			Size:     &size,
+		},
+		Archived: &archived,
+		Topics:   topics,
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	rules, err := parseRules([]byte(`[
+		{"name": "glob", "action": "activate", "glob": "our-org/*"},
+		{"name": "regexp", "action": "activate", "regexp": "^[^/]+/api-"},
+		{"name": "fork", "action": "exclude", "fork": true},
+		{"name": "archived", "action": "exclude", "archived": true},
+		{"name": "public", "action": "activate", "private": false},
+		{"name": "size", "action": "exclude", "min_size": 100, "max_size": 200},
+		{"name": "topics", "action": "activate", "topics": ["backup", "keep"]},
+		{"name": "combined", "action": "activate", "glob": "our-org/*", "private": true}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*rule{}
+	for _, r := range rules {
+		byName[r.Name] = r
+	}
+
+	tests := []struct {
+		rule    string
+		repo    *githubRepo
+		matches bool
+	}{
+		{"glob", ruleRepo("our-org/repo", false, false, true, 1), true},
+		{"glob", ruleRepo("other/repo", false, false, true, 1), false},
+		{"glob", ruleRepo("our-org/sub/repo", false, false, true, 1), false},
+		{"regexp", ruleRepo("owner/api-server", false, false, true, 1), true},
+		{"regexp", ruleRepo("owner/server-api-", false, false, true, 1), false},
+		{"fork", ruleRepo("owner/repo", true, false, true, 1), true},
+		{"fork", ruleRepo("owner/repo", false, false, true, 1), false},
+		{"fork", &githubRepo{}, false},
+		{"archived", ruleRepo("owner/repo", false, true, true, 1), true},
+		{"archived", ruleRepo("owner/repo", false, false, true, 1), false},
+		{"public", ruleRepo("owner/repo", false, false, false, 1), true},
+		{"public", ruleRepo("owner/repo", false, false, true, 1), false},
+		{"size", ruleRepo("owner/repo", false, false, true, 100), true},
+		{"size", ruleRepo("owner/repo", false, false, true, 200), true},
+		{"size", ruleRepo("owner/repo", false, false, true, 99), false},
+		{"size", ruleRepo("owner/repo", false, false, true, 201), false},
+		{"topics", ruleRepo("owner/repo", false, false, true, 1, "other", "keep"), true},
+		{"topics", ruleRepo("owner/repo", false, false, true, 1, "other"), false},
+		{"topics", ruleRepo("owner/repo", false, false, true, 1), false},
+		{"combined", ruleRepo("our-org/repo", false, false, true, 1), true},
+		{"combined", ruleRepo("our-org/repo", false, false, false, 1), false},
+	}
+	for i, test := range tests {
+		if matches := byName[test.rule].matches(test.repo); matches != test.matches {
+			t.Errorf("Test %d: rule %s matches = %v, expected %v", i, test.rule, matches, test.matches)
+		}
+	}
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	for _, data := range []string{
+		`[{"name": "a", "action": "delete"}]`,
+		`[{"name": "a", "action": "activate", "glob": "["}]`,
+		`[{"name": "a", "action": "activate", "regexp": "("}]`,
+		`{"name": "a"}`,
+	} {
+		if _, err := parseRules([]byte(data)); err == nil {
+			t.Errorf("parseRules(%s) succeeded", data)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	rules, err := parseRules([]byte(`[
+		{"name": "no forks", "action": "exclude", "fork": true},
+		{"name": "ours", "action": "activate", "glob": "our-org/*"},
+		{"name": "tagged", "action": "activate", "topics": ["backup"]},
+		{"name": "tagged ours", "action": "exclude", "glob": "our-org/*", "topics": ["backup"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		repo *githubRepo
+		rule string
+	}{
+		{ruleRepo("our-org/repo", true, false, true, 1), "no forks"},
+		{ruleRepo("our-org/repo", false, false, true, 1, "backup"), "ours"},
+		{ruleRepo("other/repo", false, false, true, 1, "backup"), "tagged"},
+		{ruleRepo("other/repo", false, false, true, 1), ""},
+	}
+	for _, test := range tests {
+		d := decide(rules, test.repo)
+		switch {
+		case test.rule == "" && d != nil:
+			t.Errorf("decide(%s) = %v, expected no decision", *test.repo.FullName, d)
+		case test.rule != "" && (d == nil || d.Rule != test.rule):
+			t.Errorf("decide(%s) = %v, expected rule %s", *test.repo.FullName, d, test.rule)
+		}
+	}
+	if d := decide(nil, ruleRepo("our-org/repo", false, false, true, 1)); d != nil {
+		t.Errorf("decide without rules = %v", d)
+	}
+}
+
+func TestApplyDecision(t *testing.T) {
+	conn := newFakeConn()
+	repo := "git@github.com:owner/repo.git"
+	active := func() bool {
+		v, _ := conn.Do("SISMEMBER", *namespace+":repos", repo)
+		return v == int64(1)
+	}
+
+	activate := &decision{"ours", actionActivate}
+	if err := applyDecision(conn, repo, activate); err != nil {
+		t.Fatal(err)
+	}
+	if !active() {
+		t.Fatalf("Repository not activated")
+	}
+
+	// Deactivating by hand sticks while the decision stays the same.
+	conn.Do("SREM", *namespace+":repos", repo)
+	if err := applyDecision(conn, repo, activate); err != nil {
+		t.Fatal(err)
+	}
+	if active() {
+		t.Errorf("Same decision reactivated a repository deactivated by hand")
+	}
+
+	if err := applyDecision(conn, repo, &decision{"no forks", actionExclude}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDecision(conn, repo, activate); err != nil {
+		t.Fatal(err)
+	}
+	if !active() {
+		t.Errorf("Repository not active after the decision changed")
+	}
+	if err := applyDecision(conn, repo, &decision{"no forks", actionExclude}); err != nil {
+		t.Fatal(err)
+	}
+	if active() {
+		t.Errorf("Repository still active after being excluded")
+	}
+	if d, err := loadDecision(conn, repo); err != nil || d == nil || d.Rule != "no forks" {
+		t.Errorf("Stored decision is %v, %v", d, err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/surma-dump/github-backup/common"
+)
+
+var (
+	generate  = flag.Bool("generate", false, "Print a new random master key and exit")
+	redisURL  = flag.String("redis", "", "Address of redis")
+	namespace = flag.String("namespace", "github-backup", "Database namespace")
+	masterKey = flag.String("master-key", "", "Comma separated master keys, the new one first, followed by the old ones (default $"+common.MasterKeyEnv+")")
+	help      = flag.Bool("help", false, "Show this help")
+)
+
+// keytool manages the master keys secrets in the database are encrypted with.
+// To rotate, generate a new key, run keytool with the new key followed by the
+// old one, then restart frontend and downloader with only the new key.
+func main() {
+	flag.Parse()
+	if *help {
+		flag.PrintDefaults()
+		return
+	}
+	if *generate {
+		key, err := common.GenerateMasterKey()
+		if err != nil {
+			log.Fatalf("Could not generate key: %s", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	if *redisURL == "" {
+		log.Fatalf("-redis has to be set")
+	}
+	sealer, err := common.NewSealer(*masterKey)
+	if err != nil {
+		log.Fatalf("Invalid master key: %s", err)
+	}
+	if err := common.CheckRedis(*redisURL); err != nil {
+		log.Fatalf("Could not connect to redis: %s", err)
+	}
+	pool := common.CreateRedisPool(*redisURL)
+	defer pool.Close()
+	conn := pool.Get()
+	defer conn.Close()
+
+	n, err := common.RotateSecrets(conn, sealer, *namespace)
+	if err != nil {
+		log.Fatalf("Could not rotate secrets (%d done): %s", n, err)
+	}
+	log.Printf("Re-encrypted %d secrets with the new master key", n)
+}
@@ -7,6 +7,18 @@
         url += e.id + '=true&';
       }
     });
+    var orgs = [].filter.call(document.querySelectorAll('#orgs input.import'), function(e) {
+      return e.checked;
+    }).map(function(e) {
+      return e.parentElement.parentElement.getAttribute('data-org');
+    });
+    var names = document.querySelector('#org-names').value;
+    if(names) {
+      orgs.push(names);
+    }
+    if(orgs.length > 0) {
+      url += 'orgs=' + encodeURIComponent(orgs.join(',')) + '&';
+    }
     window.open(url);
   });
 })();
@@ -1,21 +1,78 @@
 (function(){
   var filter = document.querySelector('x-filter');
 
+  function details(repo) {
+    var d = [repo.private ? 'private' : 'public'];
+    if(repo.fork) {
+      d.push('fork');
+    }
+    if(repo.archived) {
+      d.push('archived');
+    }
+    if(repo.size) {
+      d.push(Math.ceil(repo.size / 1024) + ' MB');
+    }
+    if(repo.default_branch) {
+      d.push(repo.default_branch);
+    }
+    if(repo.pushed_at) {
+      d.push('last push ' + repo.pushed_at.substr(0, 10));
+    }
+    return d.join(', ');
+  }
+
   Q.xhr.get('/repos').then(function(resp) {
+    resp.data.sort(function(a, b) {
+      return (a.full_name || a.ssh_url).localeCompare(b.full_name || b.ssh_url);
+    });
     resp.data.forEach(function(e) {
       var l = document.createElement('label');
-      l.setAttribute('data-value', e);
-      l.textContent = e;
+      l.setAttribute('data-value', e.ssh_url);
+      l.textContent = e.full_name || e.ssh_url;
       var i = document.createElement('input');
       i.type = 'checkbox';
       l.insertBefore(i, l.childNodes[0]);
+      if(e.id) {
+        var s = document.createElement('span');
+        s.className = 'details';
+        s.textContent = details(e);
+        l.appendChild(s);
+      }
       Polymer.dom(filter).appendChild(l);
     });
   }).then(function() {
     return Q.xhr.get('/active');
   }).then(function(resp) {
     resp.data.forEach(function(e) {
-      Polymer.dom(filter).querySelector('[data-value="' + e + '"] input').checked = true;
+      var i = Polymer.dom(filter).querySelector('[data-value="' + e.ssh_url + '"] input');
+      if(i) {
+        i.checked = true;
+      }
+    });
+  }).then(function() {
+    return Q.xhr.get('/gone');
+  }).then(function(resp) {
+    Object.keys(resp.data).forEach(function(e) {
+      var l = Polymer.dom(filter).querySelector('[data-value="' + e + '"]');
+      if(!l) {
+        return;
+      }
+      l.classList.add('gone');
+      l.title = 'Disappeared upstream on ' + resp.data[e];
+    });
+  }).then(function() {
+    return Q.xhr.get('/decisions');
+  }).then(function(resp) {
+    Object.keys(resp.data).forEach(function(e) {
+      var l = Polymer.dom(filter).querySelector('[data-value="' + e + '"]');
+      if(!l) {
+        return;
+      }
+      var d = resp.data[e];
+      var s = document.createElement('span');
+      s.className = 'decision';
+      s.textContent = (d.action == 'exclude' ? 'excluded' : 'activated') + ' by ' + d.rule;
+      l.appendChild(s);
     });
   });
 })();
@@ -0,0 +1,45 @@
+(function() {
+  var container = document.querySelector('#orgs');
+  var names = document.querySelector('#org-names');
+
+  Q.xhr.get('/orgs').then(function(resp) {
+    resp.data.forEach(function(org) {
+      var row = document.createElement('div');
+      row.className = 'org';
+      row.setAttribute('data-org', org.name);
+
+      var l = document.createElement('label');
+      var i = document.createElement('input');
+      i.type = 'checkbox';
+      i.className = 'import';
+      l.appendChild(i);
+      l.appendChild(document.createTextNode(' Repositories of ' + org.name));
+      row.appendChild(l);
+
+      var al = document.createElement('label');
+      var a = document.createElement('input');
+      a.type = 'checkbox';
+      a.className = 'auto';
+      a.checked = org.auto_activate;
+      al.appendChild(a);
+      al.appendChild(document.createTextNode(' Back up all current and future repositories'));
+      row.appendChild(al);
+
+      container.insertBefore(row, names);
+    });
+  });
+
+  container.addEventListener('change', function(ev) {
+    var input = ev.target;
+    if(!input.classList.contains('auto')) {
+      return;
+    }
+    var org = input.parentElement.parentElement.getAttribute('data-org');
+    input.disabled = true;
+    Q.xhr.get('/autoactivate?org=' + encodeURIComponent(org) + '&enabled=' + input.checked).then(function() {
+      input.disabled = false;
+    }).catch(function(err) {
+      console.error(err);
+    });
+  });
+})();